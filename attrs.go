@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Names of the extended attributes saved along with the files.
+// The local backend saves them in the user namespace, like
+// user.clawio.checksum.md5.
+const (
+	attrChecksumPrefix = "clawio.checksum."
+	attrUploaded       = "clawio.uploaded"
+	attrCorrupted      = "clawio.corrupted"
+)
+
+// Modes of the verification of the files when they are downloaded.
+const (
+	// verifyFail fails the download of corrupted files.
+	verifyFail = "fail"
+	// verifyFlag serves corrupted files but flags them.
+	verifyFlag = "flag"
+)
+
+// fileAttrs are the attributes saved along with a file.
+type fileAttrs struct {
+	checksums []*checksum
+	uploaded  time.Time
+	// corrupted is the time the file was found corrupted or zero.
+	corrupted time.Time
+}
+
+// saveAttrs saves checksums, the checksums of the contents of p,
+// and the upload time as extended attributes of p.
+func (s *server) saveAttrs(p string, checksums []*checksum) error {
+
+	attrs := map[string]string{}
+	for _, c := range checksums {
+		attrs[attrChecksumPrefix+c.Type] = c.Sum
+	}
+	attrs[attrUploaded] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	return s.storage.SetAttrs(p, attrs)
+}
+
+// getAttrs returns the attributes saved along with p.
+// Attributes that cannot be parsed are ignored.
+func (s *server) getAttrs(p string) (*fileAttrs, error) {
+
+	attrs, err := s.storage.GetAttrs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &fileAttrs{}
+	for name, value := range attrs {
+		switch {
+		case strings.HasPrefix(name, attrChecksumPrefix):
+			t := strings.TrimPrefix(name, attrChecksumPrefix)
+			if _, ok := checksumTypes[t]; ok {
+				a.checksums = append(a.checksums, &checksum{t, value})
+			}
+		case name == attrUploaded:
+			a.uploaded, _ = time.Parse(time.RFC3339Nano, value)
+		case name == attrCorrupted:
+			a.corrupted, _ = time.Parse(time.RFC3339Nano, value)
+		}
+	}
+
+	// Return them in the order of the configured types.
+	sorted := []*checksum{}
+	for _, t := range s.p.checksums {
+		if c := findChecksum(a.checksums, t); c != nil {
+			sorted = append(sorted, c)
+		}
+	}
+	for _, c := range a.checksums {
+		if findChecksum(sorted, c.Type) == nil {
+			sorted = append(sorted, c)
+		}
+	}
+	a.checksums = sorted
+
+	return a, nil
+}
+
+// flagCorrupted marks p as corrupted.
+func (s *server) flagCorrupted(p string) error {
+	attrs := map[string]string{}
+	attrs[attrCorrupted] = time.Now().UTC().Format(time.RFC3339Nano)
+	return s.storage.SetAttrs(p, attrs)
+}
+
+// verifyFile compares the checksums of fd, the contents of p, with the
+// ones saved in a when the verification is enabled. Corrupted files are
+// flagged. It reports if p can be served, otherwise the error is
+// already written into w.
+// fd is read from the start and left at the start.
+func (s *server) verifyFile(ctx context.Context, w http.ResponseWriter, p string,
+	fd io.ReadSeeker, a *fileAttrs) bool {
+
+	log := MustFromLogContext(ctx)
+
+	if s.p.verify == "" || len(a.checksums) == 0 {
+		return true
+	}
+
+	types := []string{}
+	for _, c := range a.checksums {
+		types = append(types, c.Type)
+	}
+
+	hashers, err := hashContents(fd, types...)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+
+	if err := hashers.verify(a.checksums...); err != nil {
+		log.Errorf("%s is corrupted: %s", p, err)
+
+		a.corrupted = time.Now()
+		if err := s.flagCorrupted(p); err != nil {
+			log.Error(err)
+		}
+
+		if s.p.verify == verifyFail {
+			http.Error(w, "", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	return true
+}
+
+// setAttrHeaders sets the headers for the attributes a.
+func setAttrHeaders(w http.ResponseWriter, a *fileAttrs) {
+
+	setChecksumHeaders(w, a.checksums)
+
+	if !a.uploaded.IsZero() {
+		w.Header().Set("CIO-Uploaded", a.uploaded.Format(time.RFC3339))
+	}
+
+	if !a.corrupted.IsZero() {
+		w.Header().Set("CIO-Corrupted", a.corrupted.Format(time.RFC3339))
+	}
+}
+
+// getVerifyMode checks that v is a valid verification mode.
+func getVerifyMode(v string) (string, error) {
+	switch v {
+	case "", verifyFail, verifyFlag:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown verification mode %q", v)
+	}
+}
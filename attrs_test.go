@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// corruptTestFile replaces the contents of p in the memory backend of te
+// without changing its attributes.
+func (te *testEnv) corruptTestFile(p string) {
+	m := te.s.storage.(*memoryStorage)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[p].data = []byte("HELLO")
+}
+
+func TestDownloadAttrs(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.checksums = []string{"md5"}
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+	te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+
+	w := te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if got := w.Header().Get("CIO-Checksum"); got != "md5:5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("got checksum %q", got)
+	}
+	if w.Header().Get("CIO-Uploaded") == "" {
+		t.Error("download without upload time")
+	}
+
+	// Without verification corrupted files are served as they are.
+	te.corruptTestFile(p)
+	w = te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if w.Header().Get("CIO-Corrupted") != "" {
+		t.Error("file flagged without verification")
+	}
+}
+
+func TestDownloadVerification(t *testing.T) {
+
+	for _, mode := range []string{verifyFail, verifyFlag} {
+
+		te := newTestEnv(t, func(p *newServerParams) {
+			p.checksums = []string{"md5"}
+			p.verify = mode
+		})
+
+		tk := newTestToken("ourense", nil)
+		p := testHome + "/a.txt"
+		te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+		te.expect(http.StatusOK, "GET", p, tk, "", nil)
+
+		te.corruptTestFile(p)
+		if mode == verifyFail {
+			te.expect(http.StatusInternalServerError, "GET", p, tk, "", nil)
+		} else {
+			w := te.expect(http.StatusOK, "GET", p, tk, "", nil)
+			if w.Header().Get("CIO-Corrupted") == "" {
+				t.Errorf("%s: corrupted file not flagged", mode)
+			}
+		}
+
+		attrs, err := te.s.getAttrs(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.corrupted.IsZero() {
+			t.Errorf("%s: corruption not saved", mode)
+		}
+
+		te.close()
+	}
+}
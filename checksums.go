@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+// checksumTypes are the supported checksum algorithms.
+var checksumTypes = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha1":    sha1.New,
+	"adler32": func() hash.Hash { return adler32.New() },
+	"sha256":  sha256.New,
+	"sha512":  sha512.New,
+	"crc32c":  func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"xxhash":  func() hash.Hash { return newXXHash64() },
+}
+
+// unsupportedChecksumError is returned for checksum types
+// that are not supported.
+type unsupportedChecksumError struct {
+	Type string
+}
+
+func (e *unsupportedChecksumError) Error() string {
+	types := []string{}
+	for t := range checksumTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return fmt.Sprintf("unsupported checksum type %q, supported types are %s",
+		e.Type, strings.Join(types, ", "))
+}
+
+// getChecksumTypes parses a comma separated list of checksum types.
+func getChecksumTypes(v string) ([]string, error) {
+
+	types := []string{}
+	for _, t := range strings.Split(v, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if _, ok := checksumTypes[t]; !ok {
+			return nil, &unsupportedChecksumError{t}
+		}
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+// hashers computes several checksums in one pass.
+type hashers struct {
+	types  []string
+	hashes map[string]hash.Hash
+}
+
+func newHashers(types ...string) (*hashers, error) {
+
+	h := &hashers{}
+	h.hashes = map[string]hash.Hash{}
+
+	for _, t := range types {
+		if err := h.add(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// add computes also the checksum of type t. Empty types are ignored.
+func (h *hashers) add(t string) error {
+
+	t = strings.ToLower(t)
+
+	if t == "" {
+		return nil
+	}
+
+	if _, ok := h.hashes[t]; ok {
+		return nil
+	}
+
+	newHash, ok := checksumTypes[t]
+	if !ok {
+		return &unsupportedChecksumError{t}
+	}
+
+	h.types = append(h.types, t)
+	h.hashes[t] = newHash()
+	return nil
+}
+
+func (h *hashers) Write(b []byte) (int, error) {
+	for _, hash := range h.hashes {
+		hash.Write(b)
+	}
+	return len(b), nil
+}
+
+// get returns the checksum of type t or nil if it is not computed.
+// checksums are given in hexadecimal format.
+func (h *hashers) get(t string) *checksum {
+
+	hash, ok := h.hashes[strings.ToLower(t)]
+	if !ok {
+		return nil
+	}
+
+	return &checksum{strings.ToLower(t), fmt.Sprintf("%x", hash.Sum(nil))}
+}
+
+// getAll returns all the computed checksums.
+func (h *hashers) getAll() []*checksum {
+	checksums := []*checksum{}
+	for _, t := range h.types {
+		checksums = append(checksums, h.get(t))
+	}
+	return checksums
+}
+
+// verify compares the computed checksums with the ones sent by the client.
+// Checksums without type are not verified.
+func (h *hashers) verify(checksums ...*checksum) error {
+
+	for _, chk := range checksums {
+		if chk.Type == "" {
+			continue
+		}
+
+		computed := h.get(chk.Type)
+		if computed == nil {
+			return &unsupportedChecksumError{chk.Type}
+		}
+
+		if !strings.EqualFold(computed.Sum, chk.Sum) {
+			return fmt.Errorf("corrupted file. expected %s and got %s",
+				chk.String(), computed.String())
+		}
+	}
+
+	return nil
+}
+
+// hashContents computes the checksums of types of fd, which is read
+// from the start and left at the start.
+func hashContents(fd io.ReadSeeker, types ...string) (*hashers, error) {
+
+	hashers, err := newHashers(types...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fd.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(hashers, fd); err != nil {
+		return nil, err
+	}
+
+	if _, err := fd.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	return hashers, nil
+}
+
+// findChecksum returns the first checksum in checksums whose type is
+// one of types or nil if there is none.
+func findChecksum(checksums []*checksum, types ...string) *checksum {
+	for _, t := range types {
+		for _, c := range checksums {
+			if c.Type == t {
+				return c
+			}
+		}
+	}
+	return nil
+}
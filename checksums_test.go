@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetChecksumTypes(t *testing.T) {
+
+	types, err := getChecksumTypes(" MD5, sha256,,xxhash ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(types, ",") != "md5,sha256,xxhash" {
+		t.Errorf("got types %v", types)
+	}
+
+	if _, err := getChecksumTypes("md5,md4"); err == nil {
+		t.Error("unsupported type accepted")
+	}
+}
+
+func TestHashersVerify(t *testing.T) {
+
+	h, err := newHashers("md5", "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("hello"))
+
+	md5 := &checksum{"md5", "5D41402ABC4B2A76B9719D911017C592"}
+	sha1 := &checksum{"sha1", "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}
+	if err := h.verify(md5, sha1, &checksum{}); err != nil {
+		t.Error(err)
+	}
+
+	err = h.verify(&checksum{"sha1", "0000"})
+	want := "corrupted file. expected sha1:0000 and got " + sha1.String()
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	if err := h.verify(&checksum{"sha256", "0000"}); err == nil {
+		t.Error("checksum that is not computed accepted")
+	}
+}
+
+func TestUploadChecksums(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.checksums = []string{"md5", "sha256"}
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	// Every configured checksum is computed and exposed.
+	w := te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+	got := strings.Join(w.Header()["Cio-Checksum"], ",")
+	want := "md5:5d41402abc4b2a76b9719d911017c592," +
+		"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got != want {
+		t.Errorf("got checksums %q, want %q", got, want)
+	}
+
+	// Checksums of other supported types are verified too.
+	te.expect(http.StatusCreated, "PUT", p+"?checksum=sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", tk, "hello", nil)
+	te.expect(http.StatusPreconditionFailed, "PUT", p+"?checksum=sha1:0000", tk, "hello", nil)
+	te.expect(http.StatusBadRequest, "PUT", p+"?checksum=md4:0000", tk, "hello", nil)
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// compressStorage compresses the files that compress well on top of
+// other storage backend.
+//
+// A compressed file is a valid gzip file made of independent gzip members
+// so it can be sent as it is to clients that accept the gzip encoding:
+//
+// <block 0>...<block n><index 0>...<index m><tail>
+//
+// Each block holds compressBlockSize bytes of the file, so any range can
+// be read decompressing only the blocks it spans. Blocks are flagged with
+// the CL extra subfield. The index members and the tail are empty members
+// whose extra subfields CI and CT keep the offsets of the blocks and the
+// offset of the index and the size of the decompressed file.
+//
+// Text files are always compressed. Other files are compressed if their
+// first block shrinks at least to compressMinRatio.
+// Files that are not compressed are saved as they are.
+type compressStorage struct {
+	storage
+	tmpDir string
+}
+
+// encodedOpener is implemented by the storage backends that can give
+// the contents of a file as they are saved, encoded.
+type encodedOpener interface {
+	// OpenEncoded opens p for reading without decoding it and returns its
+	// encoding, as used in the Content-Encoding header. If p is not
+	// encoded it returns an empty encoding and a nil file.
+	OpenEncoded(p string) (storageFile, string, error)
+}
+
+const (
+	compressBlockSize = 64 * 1024
+	compressMinSize   = 512
+	compressMinRatio  = 0.9
+
+	// gzip header with the FEXTRA flag and without modification time.
+	// The OS is unknown.
+	gzipExtraHeader = "\x1f\x8b\x08\x04\x00\x00\x00\x00\x00\xff"
+
+	// An empty deflate stream, the CRC-32 and the size of the empty member.
+	gzipEmptyTrailer = "\x03\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+	// Every index member holds at most this number of offsets,
+	// so the extra field fits in 65535 bytes.
+	compressIndexEntries = 8191
+
+	compressTailSize = len(gzipExtraHeader) + 2 + 4 + 16 + len(gzipEmptyTrailer)
+)
+
+func newCompressStorage(st storage, tmpDir string) *compressStorage {
+	c := &compressStorage{}
+	c.storage = st
+	c.tmpDir = tmpDir
+	return c
+}
+
+func (c *compressStorage) Open(p string) (storageFile, error) {
+
+	fd, err := c.storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return fd, nil
+	}
+
+	indexOffset, size, err := readCompressTail(fd, info)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if indexOffset < 0 {
+		// Not compressed.
+		if _, err := fd.Seek(0, 0); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return fd, nil
+	}
+
+	r := &compressReader{}
+	r.p = p
+	r.fd = fd
+	r.info = &compressFileInfo{info, size}
+	r.indexOffset = indexOffset
+	r.block = -1
+	return r, nil
+}
+
+// OpenEncoded returns the gzip file saved in p if p is compressed.
+func (c *compressStorage) OpenEncoded(p string) (storageFile, string, error) {
+
+	fd, err := c.storage.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, "", err
+	}
+
+	if info.IsDir() {
+		fd.Close()
+		return nil, "", nil
+	}
+
+	indexOffset, _, err := readCompressTail(fd, info)
+	if err != nil || indexOffset < 0 {
+		fd.Close()
+		return nil, "", err
+	}
+
+	if _, err := fd.Seek(0, 0); err != nil {
+		fd.Close()
+		return nil, "", err
+	}
+
+	return fd, "gzip", nil
+}
+
+func (c *compressStorage) Stat(p string) (os.FileInfo, error) {
+
+	info, err := c.storage.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.getDecompressedInfo(p, info)
+}
+
+func (c *compressStorage) ReadDir(p string) ([]os.FileInfo, error) {
+
+	infos, err := c.storage.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+		infos[i], err = c.getDecompressedInfo(path.Join(p, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// Commit compresses tmpFn if it compresses well.
+func (c *compressStorage) Commit(tmpFn, p string) error {
+
+	compress, err := shouldCompress(tmpFn, p)
+	if err != nil {
+		return err
+	}
+
+	if !compress {
+		return c.storage.Commit(tmpFn, p)
+	}
+
+	out, err := ioutil.TempFile(c.tmpDir, serviceID)
+	if err != nil {
+		return err
+	}
+
+	err = writeCompressed(out, tmpFn)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = c.storage.Commit(out.Name(), p)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return os.Remove(tmpFn)
+}
+
+func (c *compressStorage) getDecompressedInfo(p string, info os.FileInfo) (os.FileInfo, error) {
+
+	if info.IsDir() {
+		return info, nil
+	}
+
+	fd, err := c.storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	indexOffset, size, err := readCompressTail(fd, info)
+	if err != nil {
+		return nil, err
+	}
+
+	if indexOffset < 0 {
+		return info, nil
+	}
+
+	return &compressFileInfo{info, size}, nil
+}
+
+// shouldCompress reports if the file tmpFn to be saved in p has to be
+// compressed.
+func shouldCompress(tmpFn, p string) (bool, error) {
+
+	fd, err := os.Open(tmpFn)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	block := make([]byte, compressBlockSize)
+	n, err := io.ReadFull(fd, block)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	block = block[:n]
+
+	// Saving a file that looks like a compressed file as it is would
+	// make it be decompressed when read, so it is always compressed.
+	if isCompressed(block) {
+		return true, nil
+	}
+
+	if n < compressMinSize {
+		return false, nil
+	}
+
+	if isTextType(p, block) {
+		return true, nil
+	}
+
+	var b bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+	if err != nil {
+		return false, err
+	}
+	gz.Write(block)
+	gz.Close()
+
+	return float64(b.Len()) <= float64(n)*compressMinRatio, nil
+}
+
+// isTextType reports if the content type of p is text, based on the
+// extension of p or on the first bytes of its contents.
+func isTextType(p string, data []byte) bool {
+
+	ct := mime.TypeByExtension(path.Ext(p))
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+
+	ct = strings.TrimSpace(strings.Split(ct, ";")[0])
+
+	switch {
+	case strings.HasPrefix(ct, "text/"),
+		strings.HasSuffix(ct, "+json"),
+		strings.HasSuffix(ct, "+xml"),
+		ct == "application/json",
+		ct == "application/xml",
+		ct == "application/javascript",
+		ct == "application/x-javascript",
+		ct == "application/csv":
+		return true
+	}
+
+	return false
+}
+
+// isCompressed reports if data starts like a compressed file.
+func isCompressed(data []byte) bool {
+	return len(data) >= 14 && bytes.HasPrefix(data, []byte(gzipExtraHeader[:4])) &&
+		data[12] == 'C' && data[13] == 'L'
+}
+
+func writeCompressed(w io.Writer, tmpFn string) error {
+
+	in, err := os.Open(tmpFn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	cw := &countingWriter{w: w}
+
+	offsets := []int64{}
+	block := make([]byte, compressBlockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(in, block)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// An empty file has a single empty block.
+		if n == 0 && len(offsets) > 0 {
+			break
+		}
+
+		offsets = append(offsets, cw.n)
+		size += int64(n)
+
+		gz, err := gzip.NewWriterLevel(cw, gzip.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		gz.Header.OS = 255
+		gz.Header.Extra = []byte{'C', 'L', 0, 0}
+		if _, err := gz.Write(block[:n]); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		if n < compressBlockSize {
+			break
+		}
+	}
+
+	indexOffset := cw.n
+
+	for i := 0; i < len(offsets); i += compressIndexEntries {
+		end := i + compressIndexEntries
+		if end > len(offsets) {
+			end = len(offsets)
+		}
+		data := make([]byte, 8*(end-i))
+		for j, offset := range offsets[i:end] {
+			binary.BigEndian.PutUint64(data[8*j:], uint64(offset))
+		}
+		if err := writeEmptyMember(cw, 'C', 'I', data); err != nil {
+			return err
+		}
+	}
+
+	tail := make([]byte, 16)
+	binary.BigEndian.PutUint64(tail, uint64(indexOffset))
+	binary.BigEndian.PutUint64(tail[8:], uint64(size))
+	return writeEmptyMember(cw, 'C', 'T', tail)
+}
+
+// writeEmptyMember writes a gzip member without data and with an
+// extra subfield with the id si1 si2 and data.
+func writeEmptyMember(w io.Writer, si1, si2 byte, data []byte) error {
+
+	b := make([]byte, 0, len(gzipExtraHeader)+6+len(data)+len(gzipEmptyTrailer))
+	b = append(b, gzipExtraHeader...)
+	b = append(b, byte(len(data)+4), byte((len(data)+4)>>8))
+	b = append(b, si1, si2, byte(len(data)), byte(len(data)>>8))
+	b = append(b, data...)
+	b = append(b, gzipEmptyTrailer...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readCompressTail returns the offset of the index and the size of the
+// decompressed file fd. The offset is -1 if fd is not compressed.
+func readCompressTail(fd storageFile, info os.FileInfo) (int64, int64, error) {
+
+	if info.Size() < int64(len(gzipExtraHeader)+4+compressTailSize) {
+		return -1, 0, nil
+	}
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(fd, header); err != nil {
+		return -1, 0, err
+	}
+
+	if !isCompressed(header) {
+		return -1, 0, nil
+	}
+
+	if _, err := fd.Seek(info.Size()-int64(compressTailSize), 0); err != nil {
+		return -1, 0, err
+	}
+
+	tail := make([]byte, compressTailSize)
+	if _, err := io.ReadFull(fd, tail); err != nil {
+		return -1, 0, err
+	}
+
+	data, _, err := parseEmptyMember(tail, 'C', 'T')
+	if err != nil || len(data) != 16 {
+		return -1, 0, fmt.Errorf("corrupted compressed file tail: %v", err)
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(data))
+	size := int64(binary.BigEndian.Uint64(data[8:]))
+
+	if indexOffset >= info.Size() {
+		return -1, 0, fmt.Errorf("corrupted compressed file index offset %d", indexOffset)
+	}
+
+	return indexOffset, size, nil
+}
+
+// parseEmptyMember returns the data of the extra subfield si1 si2 of the
+// empty gzip member at the start of b and the length of the member.
+func parseEmptyMember(b []byte, si1, si2 byte) ([]byte, int, error) {
+
+	if len(b) < len(gzipExtraHeader)+6 || !bytes.HasPrefix(b, []byte(gzipExtraHeader[:4])) {
+		return nil, 0, fmt.Errorf("invalid gzip member header")
+	}
+
+	xlen := int(b[10]) | int(b[11])<<8
+	if xlen < 4 || b[12] != si1 || b[13] != si2 {
+		return nil, 0, fmt.Errorf("missing %c%c extra subfield", si1, si2)
+	}
+
+	dlen := int(b[14]) | int(b[15])<<8
+	n := len(gzipExtraHeader) + 2 + xlen + len(gzipEmptyTrailer)
+	if dlen != xlen-4 || len(b) < n {
+		return nil, 0, fmt.Errorf("truncated gzip member")
+	}
+
+	if string(b[n-len(gzipEmptyTrailer):n]) != gzipEmptyTrailer {
+		return nil, 0, fmt.Errorf("gzip member is not empty")
+	}
+
+	return b[16 : 16+dlen], n, nil
+}
+
+// compressReader decompresses a compressed file as it is read.
+type compressReader struct {
+	p           string
+	fd          storageFile
+	info        os.FileInfo
+	indexOffset int64
+	offsets     []int64
+
+	pos   int64
+	block int64
+	buf   []byte
+}
+
+func (r *compressReader) Read(b []byte) (int, error) {
+
+	if r.pos >= r.info.Size() {
+		return 0, io.EOF
+	}
+
+	if r.offsets == nil {
+		if err := r.readIndex(); err != nil {
+			return 0, err
+		}
+	}
+
+	i := r.pos / compressBlockSize
+	if i != r.block {
+		if err := r.readBlock(i); err != nil {
+			return 0, err
+		}
+	}
+
+	start := r.pos - i*compressBlockSize
+	if start >= int64(len(r.buf)) {
+		return 0, fmt.Errorf("corrupted block %d of %s", i, r.p)
+	}
+
+	n := copy(b, r.buf[start:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *compressReader) readIndex() error {
+
+	if _, err := r.fd.Seek(r.indexOffset, 0); err != nil {
+		return err
+	}
+
+	b := make([]byte, r.getEncodedSize()-int64(compressTailSize)-r.indexOffset)
+	if _, err := io.ReadFull(r.fd, b); err != nil {
+		return err
+	}
+
+	offsets := []int64{}
+	for len(b) > 0 {
+		data, n, err := parseEmptyMember(b, 'C', 'I')
+		if err != nil {
+			return fmt.Errorf("corrupted index of %s: %s", r.p, err)
+		}
+		for j := 0; j+8 <= len(data); j += 8 {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(data[j:])))
+		}
+		b = b[n:]
+	}
+
+	blocks := (r.info.Size() + compressBlockSize - 1) / compressBlockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	if int64(len(offsets)) != blocks {
+		return fmt.Errorf("corrupted index of %s: %d blocks instead of %d", r.p, len(offsets), blocks)
+	}
+
+	r.offsets = offsets
+	return nil
+}
+
+func (r *compressReader) readBlock(i int64) error {
+
+	end := r.indexOffset
+	if i+1 < int64(len(r.offsets)) {
+		end = r.offsets[i+1]
+	}
+
+	if end < r.offsets[i] {
+		return fmt.Errorf("corrupted index of %s", r.p)
+	}
+
+	if _, err := r.fd.Seek(r.offsets[i], 0); err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(io.LimitReader(r.fd, end-r.offsets[i]))
+	if err != nil {
+		return fmt.Errorf("corrupted block %d of %s: %s", i, r.p, err)
+	}
+
+	buf, err := ioutil.ReadAll(gz)
+	if err != nil {
+		r.block = -1
+		return fmt.Errorf("corrupted block %d of %s: %s", i, r.p, err)
+	}
+
+	r.buf = buf
+	r.block = i
+	return nil
+}
+
+func (r *compressReader) getEncodedSize() int64 {
+	return r.info.(*compressFileInfo).FileInfo.Size()
+}
+
+func (r *compressReader) Seek(offset int64, whence int) (int64, error) {
+
+	var pos int64
+	switch whence {
+	case 0:
+		pos = offset
+	case 1:
+		pos = r.pos + offset
+	case 2:
+		pos = r.info.Size() + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *compressReader) Close() error {
+	return r.fd.Close()
+}
+
+func (r *compressReader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+// compressFileInfo is the information of a compressed file with the size
+// of its decompressed contents.
+type compressFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *compressFileInfo) Size() int64 {
+	return i.size
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// acceptsEncoding reports if the client accepts the content encoding enc
+// in the Accept-Encoding header.
+func acceptsEncoding(r *http.Request, enc string) bool {
+
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != enc && name != "x-"+enc && name != "*" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				return err == nil && q > 0
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
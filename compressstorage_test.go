@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestCompressStorage(t *testing.T) (*compressStorage, *memoryStorage, string) {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMemoryStorage()
+	if err := storageMkdirAll(m, testHome); err != nil {
+		t.Fatal(err)
+	}
+
+	return newCompressStorage(m, dir), m, dir
+}
+
+func TestCompressStorageFormat(t *testing.T) {
+
+	c, m, dir := newTestCompressStorage(t)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 3*compressBlockSize+100; i++ {
+		fmt.Fprintf(&buf, "line %d of a text file\n", i)
+	}
+	data := buf.Bytes()
+
+	p := testHome + "/a.txt"
+	commitTestFile(t, c, p, data)
+
+	raw := m.files[p].data
+	if len(raw) >= len(data) {
+		t.Fatalf("file not compressed: %d bytes", len(raw))
+	}
+
+	// The saved file is a valid gzip file with the contents.
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("gunzipped contents differ")
+	}
+
+	fd, enc, err := c.OpenEncoded(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	if enc != "gzip" {
+		t.Errorf("got encoding %q, want gzip", enc)
+	}
+
+	info, err := c.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("size is %d, want %d", info.Size(), len(data))
+	}
+
+	got, err = readTestFile(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decompressed contents differ")
+	}
+
+	// Ranges spanning several blocks.
+	fd, err = c.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	for _, r := range [][2]int64{{0, 1}, {compressBlockSize - 5, 10}, {compressBlockSize + 3, 2*compressBlockSize + 14}} {
+		if _, err := fd.Seek(r[0], 0); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, r[1])
+		if _, err := io.ReadFull(fd, b); err != nil {
+			t.Fatalf("range %v: %s", r, err)
+		}
+		if !bytes.Equal(b, data[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v differs", r)
+		}
+	}
+}
+
+func TestCompressStorageIncompressible(t *testing.T) {
+
+	c, m, dir := newTestCompressStorage(t)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, compressBlockSize)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testHome + "/a.bin"
+	commitTestFile(t, c, p, data)
+
+	if !bytes.Equal(m.files[p].data, data) {
+		t.Error("incompressible file saved compressed")
+	}
+
+	fd, enc, err := c.OpenEncoded(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd != nil || enc != "" {
+		t.Errorf("got encoding %q for a file saved as it is", enc)
+	}
+
+	got, err := readTestFile(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("contents differ")
+	}
+}
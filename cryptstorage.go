@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// cryptStorage encrypts the files of every user with the data key of
+// the user on top of other storage backend.
+//
+// Files are encrypted with AES-256-GCM in chunks of cryptChunkSize bytes,
+// so any range of a file can be read decrypting only the chunks it spans.
+// An encrypted file is made of a header with the magic string and a random
+// salt followed by the chunks:
+//
+// <magic><salt><chunk 0>...<chunk n>
+//
+// Every file is encrypted with its own key, derived from the data key and
+// the salt with HMAC-SHA256, and the nonce of each chunk is its index.
+// The last chunk is flagged in the additional data, so truncated
+// files are detected. An empty file has a single empty chunk.
+//
+// The owner of a file is the pid found in its path, so the files
+// in the homes, versions and trash areas are encrypted.
+// Other files and files saved before enabling the encryption are
+// used as they are.
+//
+// Encrypted files are not deduplicated because the same contents
+// are encrypted differently every time.
+type cryptStorage struct {
+	storage
+	keyring *keyring
+	tmpDir  string
+}
+
+const (
+	cryptMagic      = "CIOENC01"
+	cryptSaltSize   = 16
+	cryptHeaderSize = len(cryptMagic) + cryptSaltSize
+	cryptChunkSize  = 64 * 1024
+	cryptOverhead   = 16
+)
+
+func newCryptStorage(st storage, keyFile, tmpDir string) (*cryptStorage, error) {
+
+	k, err := newKeyring(keyFile, st, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cryptStorage{}
+	c.storage = st
+	c.keyring = k
+	c.tmpDir = tmpDir
+	return c, nil
+}
+
+func (c *cryptStorage) Open(p string) (storageFile, error) {
+
+	fd, err := c.storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	pid := getOwner(p)
+	if pid == "" || info.IsDir() {
+		return fd, nil
+	}
+
+	salt, err := readCryptHeader(fd, info)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if salt == nil {
+		// Not encrypted.
+		if _, err := fd.Seek(0, 0); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return fd, nil
+	}
+
+	aead, err := c.getFileCipher(pid, salt)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	r := &cryptReader{}
+	r.p = p
+	r.fd = fd
+	r.aead = aead
+	r.info = &cryptFileInfo{info, getPlainSize(info.Size())}
+	r.chunks = getChunks(info.Size())
+	r.chunk = -1
+	return r, nil
+}
+
+func (c *cryptStorage) Stat(p string) (os.FileInfo, error) {
+
+	info, err := c.storage.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.getPlainInfo(p, info)
+}
+
+func (c *cryptStorage) ReadDir(p string) ([]os.FileInfo, error) {
+
+	infos, err := c.storage.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+		infos[i], err = c.getPlainInfo(path.Join(p, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// Commit encrypts tmpFn with the data key of the owner of p.
+func (c *cryptStorage) Commit(tmpFn, p string) error {
+
+	pid := getOwner(p)
+	if pid == "" {
+		return c.storage.Commit(tmpFn, p)
+	}
+
+	encFn, err := c.encrypt(tmpFn, pid)
+	if err != nil {
+		return err
+	}
+
+	if err := c.storage.Commit(encFn, p); err != nil {
+		os.Remove(encFn)
+		return err
+	}
+
+	return os.Remove(tmpFn)
+}
+
+// encrypt saves the encrypted contents of tmpFn into a new tmp file
+// and returns its name.
+func (c *cryptStorage) encrypt(tmpFn, pid string) (string, error) {
+
+	in, err := os.Open(tmpFn)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, cryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	aead, err := c.getFileCipher(pid, salt)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ioutil.TempFile(c.tmpDir, serviceID)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeEncrypted(out, in, info.Size(), aead, salt)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+func writeEncrypted(w io.Writer, r io.Reader, size int64, aead cipher.AEAD, salt []byte) error {
+
+	if _, err := io.WriteString(w, cryptMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return err
+	}
+
+	chunks := (size + cryptChunkSize - 1) / cryptChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	buf := make([]byte, cryptChunkSize)
+	sealed := make([]byte, 0, cryptChunkSize+cryptOverhead)
+	for i := int64(0); i < chunks; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+
+		last := i == chunks-1
+		sealed = aead.Seal(sealed[:0], getChunkNonce(aead, i), buf[:n], getChunkAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getPlainInfo returns info with the size of the decrypted contents.
+func (c *cryptStorage) getPlainInfo(p string, info os.FileInfo) (os.FileInfo, error) {
+
+	if info.IsDir() || getOwner(p) == "" {
+		return info, nil
+	}
+
+	fd, err := c.storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	salt, err := readCryptHeader(fd, info)
+	if err != nil {
+		return nil, err
+	}
+
+	if salt == nil {
+		return info, nil
+	}
+
+	return &cryptFileInfo{info, getPlainSize(info.Size())}, nil
+}
+
+// getFileCipher returns the cipher for the file of pid with salt.
+func (c *cryptStorage) getFileCipher(pid string, salt []byte) (cipher.AEAD, error) {
+
+	key, err := c.keyring.getKey(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+
+	return newGCM(mac.Sum(nil))
+}
+
+// readCryptHeader returns the salt of the encrypted file fd or nil if
+// fd is not encrypted.
+func readCryptHeader(fd storageFile, info os.FileInfo) ([]byte, error) {
+
+	if info.Size() < int64(cryptHeaderSize+cryptOverhead) {
+		return nil, nil
+	}
+
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(fd, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(header, []byte(cryptMagic)) {
+		return nil, nil
+	}
+
+	return header[len(cryptMagic):], nil
+}
+
+// getOwner returns the pid of the user that owns p or an empty string
+// if p is not owned by any user.
+// /local/users/<letter>/<pid>/..., /versions/<letter>/<pid>/... and
+// /trash/<letter>/<pid>/... are owned by <pid>.
+func getOwner(p string) string {
+
+	p = path.Clean(p)
+
+	var rest string
+	for _, root := range []string{"/local/users", versionsRoot, trashRoot} {
+		if strings.HasPrefix(p, root+"/") {
+			rest = strings.TrimPrefix(p, root+"/")
+			break
+		}
+	}
+
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// getChunks returns the number of chunks of an encrypted file of size bytes.
+func getChunks(size int64) int64 {
+	body := size - int64(cryptHeaderSize)
+	return (body + cryptChunkSize + cryptOverhead - 1) / (cryptChunkSize + cryptOverhead)
+}
+
+// getPlainSize returns the size of the contents of an encrypted file
+// of size bytes.
+func getPlainSize(size int64) int64 {
+	return size - int64(cryptHeaderSize) - getChunks(size)*cryptOverhead
+}
+
+func getChunkNonce(aead cipher.AEAD, i int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(i))
+	return nonce
+}
+
+func getChunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// cryptReader decrypts an encrypted file as it is read.
+type cryptReader struct {
+	p      string
+	fd     storageFile
+	aead   cipher.AEAD
+	info   os.FileInfo
+	chunks int64
+
+	pos   int64
+	chunk int64
+	buf   []byte
+}
+
+func (r *cryptReader) Read(b []byte) (int, error) {
+
+	if r.pos >= r.info.Size() {
+		return 0, io.EOF
+	}
+
+	i := r.pos / cryptChunkSize
+	if i != r.chunk {
+		if err := r.readChunk(i); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf[r.pos-i*cryptChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *cryptReader) readChunk(i int64) error {
+
+	offset := int64(cryptHeaderSize) + i*(cryptChunkSize+cryptOverhead)
+	if _, err := r.fd.Seek(offset, 0); err != nil {
+		return err
+	}
+
+	sealed := make([]byte, cryptChunkSize+cryptOverhead)
+	n, err := io.ReadFull(r.fd, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	buf, err := r.aead.Open(r.buf[:0], getChunkNonce(r.aead, i), sealed[:n], getChunkAD(i == r.chunks-1))
+	if err != nil {
+		r.chunk = -1
+		return fmt.Errorf("corrupted chunk %d of %s", i, r.p)
+	}
+
+	r.buf = buf
+	r.chunk = i
+	return nil
+}
+
+func (r *cryptReader) Seek(offset int64, whence int) (int64, error) {
+
+	var pos int64
+	switch whence {
+	case 0:
+		pos = offset
+	case 1:
+		pos = r.pos + offset
+	case 2:
+		pos = r.info.Size() + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *cryptReader) Close() error {
+	return r.fd.Close()
+}
+
+func (r *cryptReader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+// cryptFileInfo is the information of an encrypted file with the size
+// of its decrypted contents.
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *cryptFileInfo) Size() int64 {
+	return i.size
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeTestKeyFile writes a key file with a random master key into fn.
+func writeTestKeyFile(t *testing.T, fn string) {
+
+	master := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		t.Fatal(err)
+	}
+
+	kf := &keyFile{}
+	kf.Current = "m1"
+	kf.Keys = map[string]string{"m1": base64.StdEncoding.EncodeToString(master)}
+	data, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestCryptStorage returns a cryptStorage on top of a memory storage
+// with the home of ourense. The caller must remove the returned dir.
+func newTestCryptStorage(t *testing.T) (*cryptStorage, *memoryStorage, string) {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestKeyFile(t, dir+"/keys.json")
+
+	m := newMemoryStorage()
+	if err := storageMkdirAll(m, testHome); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newCryptStorage(m, dir+"/keys.json", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, m, dir
+}
+
+func TestCryptStorageChunks(t *testing.T) {
+
+	c, m, dir := newTestCryptStorage(t)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 3*cryptChunkSize+17)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testHome + "/f"
+	commitTestFile(t, c, p, data)
+
+	raw := m.files[p].data
+	if !bytes.HasPrefix(raw, []byte(cryptMagic)) || bytes.Contains(raw, data[:64]) {
+		t.Fatal("file not encrypted")
+	}
+	if want := int64(cryptHeaderSize) + int64(len(data)) + 4*cryptOverhead; int64(len(raw)) != want {
+		t.Errorf("encrypted size is %d, want %d", len(raw), want)
+	}
+
+	info, err := c.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("size is %d, want %d", info.Size(), len(data))
+	}
+
+	got, err := readTestFile(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decrypted contents differ")
+	}
+
+	// Ranges spanning several chunks.
+	fd, err := c.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	for _, r := range [][2]int64{{0, 1}, {cryptChunkSize - 5, 10}, {cryptChunkSize, cryptChunkSize}, {cryptChunkSize + 3, 2*cryptChunkSize + 14}} {
+		if _, err := fd.Seek(r[0], 0); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, r[1])
+		if _, err := io.ReadFull(fd, buf); err != nil {
+			t.Fatalf("range %v: %s", r, err)
+		}
+		if !bytes.Equal(buf, data[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v differs", r)
+		}
+	}
+
+	// Files outside the homes are not encrypted.
+	if err := storageMkdirAll(m, "/other"); err != nil {
+		t.Fatal(err)
+	}
+	commitTestFile(t, c, "/other/f", []byte("plain"))
+	if string(m.files["/other/f"].data) != "plain" {
+		t.Error("file outside the homes encrypted")
+	}
+}
+
+func TestCryptStorageTampering(t *testing.T) {
+
+	c, m, dir := newTestCryptStorage(t)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("x"), 2*cryptChunkSize+1)
+	p := testHome + "/f"
+
+	// A flipped bit.
+	commitTestFile(t, c, p, data)
+	m.files[p].data[cryptHeaderSize+cryptChunkSize+100] ^= 1
+	if _, err := readTestFile(c, p); err == nil {
+		t.Error("tampered file decrypted")
+	}
+
+	// A truncated file that ends in a chunk boundary.
+	commitTestFile(t, c, p, data)
+	raw := m.files[p].data
+	m.files[p].data = raw[:cryptHeaderSize+2*(cryptChunkSize+cryptOverhead)]
+	if _, err := readTestFile(c, p); err == nil {
+		t.Error("truncated file decrypted")
+	}
+
+	// Swapped chunks.
+	commitTestFile(t, c, p, append(bytes.Repeat([]byte("a"), cryptChunkSize), bytes.Repeat([]byte("b"), cryptChunkSize+1)...))
+	raw = m.files[p].data
+	chunk := cryptChunkSize + cryptOverhead
+	swapped := append([]byte{}, raw[:cryptHeaderSize]...)
+	swapped = append(swapped, raw[cryptHeaderSize+chunk:cryptHeaderSize+2*chunk]...)
+	swapped = append(swapped, raw[cryptHeaderSize:cryptHeaderSize+chunk]...)
+	swapped = append(swapped, raw[cryptHeaderSize+2*chunk:]...)
+	m.files[p].data = swapped
+	if _, err := readTestFile(c, p); err == nil {
+		t.Error("file with swapped chunks decrypted")
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupStorage stores every file once by the hash of its content on top
+// of another storage backend.
+//
+// The content is saved as a blob in /blobs/<checksum type>/<xx>/<checksum>
+// and the path of the file is an empty file with the reference to the blob
+// saved in its attributes, so the contents of the users can never be taken
+// as references. The number of references to each blob is counted, so
+// removing a file only removes its reference. Blobs that are not referenced
+// anymore are removed by collectGarbage.
+//
+// Files that are not references, like the ones saved before enabling the
+// deduplication, are used as they are. The backend must support attributes.
+//
+// The reference counts are kept in memory and computed walking the
+// storage when the server starts.
+type dedupStorage struct {
+	storage
+	tmpDir string
+
+	// mu protects refs. The commits and the removals of a blob are
+	// serialized with the lock of the blob.
+	mu   sync.Mutex
+	refs map[string]int64
+
+	blobsMu   sync.Mutex
+	blobLocks map[string]*pathLock
+}
+
+const (
+	blobsRoot = "/blobs"
+
+	// dedupTmpRoot is where the references are written before being
+	// renamed to their path along with their attributes.
+	dedupTmpRoot = blobsRoot + "/tmp"
+
+	dedupGCInterval = time.Hour
+
+	// attrDedupRef is the attribute that holds the reference.
+	attrDedupRef = "clawio.dedup.ref"
+)
+
+type dedupRef struct {
+	Blob string `json:"blob"`
+	Size int64  `json:"size"`
+}
+
+func newDedupStorage(st storage, tmpDir string) (*dedupStorage, error) {
+
+	d := &dedupStorage{}
+	d.storage = st
+	d.tmpDir = tmpDir
+	d.refs = map[string]int64{}
+	d.blobLocks = map[string]*pathLock{}
+
+	// References left by a commit that did not finish.
+	if err := st.RemoveAll(dedupTmpRoot); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err := d.walk("/", func(p string, ref *dedupRef) {
+		d.refs[ref.Blob]++
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Infof("found %d referenced blobs", len(d.refs))
+
+	return d, nil
+}
+
+func (d *dedupStorage) Open(p string) (storageFile, error) {
+
+	info, ref, err := d.stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if ref == nil {
+		return d.storage.Open(p)
+	}
+
+	fd, err := d.storage.Open(ref.Blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupFile{fd, info}, nil
+}
+
+func (d *dedupStorage) Stat(p string) (os.FileInfo, error) {
+	info, _, err := d.stat(p)
+	return info, err
+}
+
+func (d *dedupStorage) ReadDir(p string) ([]os.FileInfo, error) {
+
+	infos, err := d.storage.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		ref, err := d.readRef(path.Join(p, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			infos[i] = &dedupFileInfo{info, ref.Size}
+		}
+	}
+
+	return infos, nil
+}
+
+func (d *dedupStorage) Commit(tmpFn, p string) error {
+	return d.CommitChecksum(tmpFn, p, nil)
+}
+
+// CommitChecksum saves the contents of tmpFn as a blob, unless an equal
+// blob already exists, and makes p a reference to it.
+// Only sha256, sha1 and md5 checksums are used to identify blobs, if none
+// of them is given the sha1 of tmpFn is computed.
+func (d *dedupStorage) CommitChecksum(tmpFn, p string, checksums []*checksum) error {
+
+	tmpInfo, err := os.Stat(tmpFn)
+	if err != nil {
+		return err
+	}
+
+	chk := findChecksum(checksums, "sha256", "sha1", "md5")
+	if chk == nil {
+		chk, err = getFileSHA1(tmpFn)
+		if err != nil {
+			return err
+		}
+	}
+
+	blob := path.Join(blobsRoot, chk.Type, chk.Sum[:2], chk.Sum)
+
+	// The blob cannot be removed by the garbage collector until
+	// it is referenced.
+	d.lockBlob(blob)
+	defer d.unlockBlob(blob)
+
+	_, err = d.storage.Stat(blob)
+	if err == nil {
+		// The checksum could collide, so the contents are compared
+		// before sharing the blob.
+		same, err := d.isSameContent(tmpFn, blob)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("%s has the checksum %s of blob %s but different contents",
+				tmpFn, chk.String(), blob)
+		}
+		if err := os.Remove(tmpFn); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		if err := storageMkdirAll(d.storage, path.Dir(blob)); err != nil {
+			return err
+		}
+		if err := d.storage.Commit(tmpFn, blob); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+
+	old, err := d.getRef(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// If saving the reference fails the blob can be left unreferenced
+	// and it will be removed by the garbage collector.
+	if err := d.writeRef(p, &dedupRef{blob, tmpInfo.Size()}); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.refs[blob]++
+	if old != nil {
+		d.refs[old.Blob]--
+	}
+	d.mu.Unlock()
+
+	return nil
+}
+
+func (d *dedupStorage) Remove(p string) error {
+
+	ref, err := d.getRef(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := d.storage.Remove(p); err != nil {
+		return err
+	}
+
+	if ref != nil {
+		d.mu.Lock()
+		d.refs[ref.Blob]--
+		d.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (d *dedupStorage) RemoveAll(p string) error {
+
+	refs := []*dedupRef{}
+	err := d.walk(p, func(p string, ref *dedupRef) {
+		refs = append(refs, ref)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := d.storage.RemoveAll(p); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	for _, ref := range refs {
+		d.refs[ref.Blob]--
+	}
+	d.mu.Unlock()
+
+	return nil
+}
+
+func (d *dedupStorage) Rename(src, dst string) error {
+
+	// A file in dst is replaced, so its reference is lost.
+	var old *dedupRef
+	if path.Clean(src) != path.Clean(dst) {
+		ref, err := d.getRef(dst)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		old = ref
+	}
+
+	if err := d.storage.Rename(src, dst); err != nil {
+		return err
+	}
+
+	if old != nil {
+		d.mu.Lock()
+		d.refs[old.Blob]--
+		d.mu.Unlock()
+	}
+
+	return nil
+}
+
+// collectGarbage removes the unreferenced blobs periodically.
+func (d *dedupStorage) collectGarbage() {
+
+	ticker := time.NewTicker(dedupGCInterval)
+	defer ticker.Stop()
+
+	for {
+		d.removeUnreferencedBlobs()
+		<-ticker.C
+	}
+}
+
+func (d *dedupStorage) removeUnreferencedBlobs() {
+
+	// /blobs/<checksum type>/<xx>/<checksum>
+	types, err := d.storage.ReadDir(blobsRoot)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	var removed, freed int64
+	for _, t := range types {
+		if path.Join(blobsRoot, t.Name()) == dedupTmpRoot {
+			continue
+		}
+
+		prefixes, err := d.storage.ReadDir(path.Join(blobsRoot, t.Name()))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, prefix := range prefixes {
+			dir := path.Join(blobsRoot, t.Name(), prefix.Name())
+
+			blobs, err := d.storage.ReadDir(dir)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			for _, info := range blobs {
+				blob := path.Join(dir, info.Name())
+
+				d.lockBlob(blob)
+				d.mu.Lock()
+				referenced := d.refs[blob] > 0
+				d.mu.Unlock()
+				if referenced {
+					d.unlockBlob(blob)
+					continue
+				}
+				err := d.storage.Remove(blob)
+				if err == nil {
+					d.mu.Lock()
+					delete(d.refs, blob)
+					d.mu.Unlock()
+				}
+				d.unlockBlob(blob)
+
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+
+				removed++
+				freed += info.Size()
+				log.Infof("removed unreferenced blob %s", blob)
+			}
+		}
+	}
+
+	log.Infof("garbage collection removed %d blobs and freed %d bytes", removed, freed)
+}
+
+// stat returns the information of p and the blob it references.
+// ref is nil if p is not a reference.
+func (d *dedupStorage) stat(p string) (os.FileInfo, *dedupRef, error) {
+
+	info, err := d.storage.Stat(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		return info, nil, nil
+	}
+
+	ref, err := d.readRef(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ref == nil {
+		return info, nil, nil
+	}
+
+	return &dedupFileInfo{info, ref.Size}, ref, nil
+}
+
+// getRef returns the reference saved in p or nil if p
+// is not a reference.
+func (d *dedupStorage) getRef(p string) (*dedupRef, error) {
+	_, ref, err := d.stat(p)
+	return ref, err
+}
+
+// readRef returns the reference saved in the attributes of the file p
+// or nil if p is not a reference.
+func (d *dedupStorage) readRef(p string) (*dedupRef, error) {
+
+	attrs, err := d.storage.GetAttrs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := attrs[attrDedupRef]
+	if !ok {
+		return nil, nil
+	}
+
+	ref := &dedupRef{}
+	if err := json.Unmarshal([]byte(v), ref); err != nil {
+		return nil, fmt.Errorf("corrupted reference %s: %s", p, err)
+	}
+
+	// A reference can only point to a blob.
+	blob := path.Clean(ref.Blob)
+	if blob != ref.Blob || !strings.HasPrefix(blob, blobsRoot+"/") ||
+		strings.HasPrefix(blob, dedupTmpRoot+"/") {
+		return nil, fmt.Errorf("reference %s points outside of the blobs to %s", p, ref.Blob)
+	}
+
+	return ref, nil
+}
+
+// writeRef makes p a reference to ref.Blob. The reference is written
+// with its attribute in the tmp root and renamed to p, so p is never
+// left as an empty file without the reference.
+func (d *dedupStorage) writeRef(p string, ref *dedupRef) error {
+
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(d.tmpDir, serviceID)
+	if err != nil {
+		return err
+	}
+	fd.Close()
+
+	if err := storageMkdirAll(d.storage, dedupTmpRoot); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	refTmp := path.Join(dedupTmpRoot, path.Base(fd.Name()))
+	if err := d.storage.Commit(fd.Name(), refTmp); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	err = d.storage.SetAttrs(refTmp, map[string]string{attrDedupRef: string(data)})
+	if err == nil {
+		err = d.storage.Rename(refTmp, p)
+	}
+	if err != nil {
+		d.storage.Remove(refTmp)
+		return err
+	}
+
+	return nil
+}
+
+// walk calls fn for every reference found under p, skipping the blobs.
+func (d *dedupStorage) walk(p string, fn func(p string, ref *dedupRef)) error {
+
+	if path.Clean(p) == blobsRoot {
+		return nil
+	}
+
+	info, ref, err := d.stat(p)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if ref != nil {
+			fn(p, ref)
+		}
+		return nil
+	}
+
+	infos, err := d.storage.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := d.walk(path.Join(p, info.Name()), fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isSameContent reports if the local file fn and the blob have the
+// same contents.
+func (d *dedupStorage) isSameContent(fn, blob string) (bool, error) {
+
+	f1, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+
+	f2, err := d.storage.Open(blob)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	b1 := make([]byte, 32*1024)
+	b2 := make([]byte, 32*1024)
+	for {
+		n1, err1 := io.ReadFull(f1, b1)
+		n2, err2 := io.ReadFull(f2, b2)
+		if !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// lockBlob blocks until no other commit or removal holds the lock of blob.
+func (d *dedupStorage) lockBlob(blob string) {
+
+	d.blobsMu.Lock()
+	l, ok := d.blobLocks[blob]
+	if !ok {
+		l = &pathLock{}
+		d.blobLocks[blob] = l
+	}
+	l.refs++
+	d.blobsMu.Unlock()
+
+	l.mu.Lock()
+}
+
+// unlockBlob releases the lock of blob taken with lockBlob.
+func (d *dedupStorage) unlockBlob(blob string) {
+
+	d.blobsMu.Lock()
+	defer d.blobsMu.Unlock()
+
+	l := d.blobLocks[blob]
+	l.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(d.blobLocks, blob)
+	}
+}
+
+// getFileSHA1 returns the sha1 checksum of the local file fn.
+func getFileSHA1(fn string) (*checksum, error) {
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, fd); err != nil {
+		return nil, err
+	}
+
+	return &checksum{"sha1", fmt.Sprintf("%x", hasher.Sum(nil))}, nil
+}
+
+// dedupFile is a blob opened for reading through a reference.
+type dedupFile struct {
+	storageFile
+	info os.FileInfo
+}
+
+func (f *dedupFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// dedupFileInfo is the information of a reference with the size of the
+// blob it references.
+type dedupFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *dedupFileInfo) Size() int64 {
+	return i.size
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestDedupStorage(t *testing.T) (*dedupStorage, *memoryStorage, string) {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMemoryStorage()
+	if err := storageMkdirAll(m, testHome); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newDedupStorage(m, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, m, dir
+}
+
+// getBlobs returns the paths of the blobs saved in m.
+func getBlobs(m *memoryStorage) []string {
+	blobs := []string{}
+	for p := range m.files {
+		if path.Dir(path.Dir(path.Dir(p))) == blobsRoot {
+			blobs = append(blobs, p)
+		}
+	}
+	return blobs
+}
+
+func TestDedupStorageRefs(t *testing.T) {
+
+	d, m, dir := newTestDedupStorage(t)
+	defer os.RemoveAll(dir)
+
+	a, b := testHome+"/a", testHome+"/b"
+	commitTestFile(t, d, a, []byte("same contents"))
+	commitTestFile(t, d, b, []byte("same contents"))
+
+	blobs := getBlobs(m)
+	if len(blobs) != 1 {
+		t.Fatalf("got blobs %v, want one", blobs)
+	}
+	blob := blobs[0]
+	if d.refs[blob] != 2 {
+		t.Errorf("blob has %d references, want 2", d.refs[blob])
+	}
+
+	info, err := d.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("same contents")) {
+		t.Errorf("size is %d, want %d", info.Size(), len("same contents"))
+	}
+
+	// The references are counted again when the storage is opened.
+	d2, err := newDedupStorage(m, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.refs[blob] != 2 {
+		t.Errorf("blob has %d references after reopening, want 2", d2.refs[blob])
+	}
+
+	if err := d.Rename(a, testHome+"/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	if d.refs[blob] != 1 {
+		t.Errorf("blob has %d references, want 1", d.refs[blob])
+	}
+
+	d.removeUnreferencedBlobs()
+	data, err := readTestFile(d, testHome+"/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "same contents" {
+		t.Errorf("got %q", data)
+	}
+
+	// Replacing the last reference leaves the blob unreferenced.
+	commitTestFile(t, d, testHome+"/c", []byte("other contents"))
+	d.removeUnreferencedBlobs()
+	if _, err := m.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("unreferenced blob %s not removed", blob)
+	}
+}
+
+func TestDedupStorageRefsInAttributes(t *testing.T) {
+
+	d, m, dir := newTestDedupStorage(t)
+	defer os.RemoveAll(dir)
+
+	commitTestFile(t, d, testHome+"/a", []byte("secret"))
+	blob := getBlobs(m)[0]
+
+	// Contents that look like a reference are saved as they are.
+	crafted := `{"blob":"` + blob + `","size":6}`
+	commitTestFile(t, d, testHome+"/b", []byte(crafted))
+	data, err := readTestFile(d, testHome+"/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != crafted {
+		t.Errorf("got %q, want %q", data, crafted)
+	}
+
+	// References outside of the blobs are rejected.
+	for _, forged := range []string{testHome + "/a", blobsRoot + "/../local/x", dedupTmpRoot + "/x"} {
+		if err := m.SetAttrs(testHome+"/b", map[string]string{attrDedupRef: `{"blob":"` + forged + `"}`}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Open(testHome + "/b"); err == nil {
+			t.Errorf("reference to %s accepted", forged)
+		}
+	}
+}
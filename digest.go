@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// digestAlgorithm is an algorithm of the HTTP Digest header (RFC 3230).
+type digestAlgorithm struct {
+	name string
+	typ  string
+	// hex is true for the algorithms whose digests are encoded
+	// in hexadecimal instead of base64.
+	hex bool
+}
+
+var digestAlgorithms = []*digestAlgorithm{
+	{"MD5", "md5", false},
+	{"SHA", "sha1", false},
+	{"SHA-256", "sha256", false},
+	{"SHA-512", "sha512", false},
+	{"ADLER32", "adler32", true},
+	{"CRC32C", "crc32c", true},
+}
+
+func getDigestAlgorithm(name string) *digestAlgorithm {
+	for _, a := range digestAlgorithms {
+		if strings.EqualFold(a.name, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+// getChecksumsFromReq returns the checksums sent by the client in the
+// CIO-Checksum header or the checksum query param, in the Digest
+// header and in the Content-MD5 header.
+// Algorithms of the Digest header that are not supported are ignored.
+func (s *server) getChecksumsFromReq(r *http.Request) ([]*checksum, error) {
+
+	checksums := []*checksum{}
+
+	if chk := s.getChecksumInfo(r); chk.Type != "" {
+		checksums = append(checksums, chk)
+	}
+
+	for _, v := range r.Header["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid digest %q", d)
+			}
+
+			a := getDigestAlgorithm(parts[0])
+			if a == nil {
+				continue
+			}
+
+			sum, err := decodeDigest(a, parts[1])
+			if err != nil {
+				return nil, err
+			}
+
+			checksums = append(checksums, &checksum{a.typ, sum})
+		}
+	}
+
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		sum, err := decodeDigest(getDigestAlgorithm("MD5"), v)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, &checksum{"md5", sum})
+	}
+
+	return checksums, nil
+}
+
+// decodeDigest returns the digest v of the algorithm a in hexadecimal.
+func decodeDigest(a *digestAlgorithm, v string) (string, error) {
+
+	if a.hex {
+		if _, err := hex.DecodeString(v); err != nil {
+			return "", fmt.Errorf("invalid %s digest %q", a.name, v)
+		}
+		return strings.ToLower(v), nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s digest %q", a.name, v)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// encodeDigest returns the value of the Digest header for chk.
+func encodeDigest(a *digestAlgorithm, chk *checksum) (string, error) {
+
+	if a.hex {
+		return a.name + "=" + chk.Sum, nil
+	}
+
+	b, err := hex.DecodeString(chk.Sum)
+	if err != nil {
+		return "", err
+	}
+
+	return a.name + "=" + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// getWantedDigest returns the supported algorithm with the highest
+// preference in the Want-Digest header or nil if there is none.
+func getWantedDigest(r *http.Request) *digestAlgorithm {
+
+	var wanted *digestAlgorithm
+	var wantedQ float64
+
+	for _, v := range strings.Split(r.Header.Get("Want-Digest"), ",") {
+		parts := strings.Split(v, ";")
+
+		a := getDigestAlgorithm(strings.TrimSpace(parts[0]))
+		if a == nil {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				f, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					f = 0
+				}
+				q = f
+			}
+		}
+
+		if q > wantedQ {
+			wanted = a
+			wantedQ = q
+		}
+	}
+
+	return wanted
+}
+
+// setDigestHeader sets the Digest header asked for in the Want-Digest
+// header. The digest is taken from saved, the checksums saved for fd, or
+// computed reading fd from the start. fd is left at the start.
+func setDigestHeader(w http.ResponseWriter, r *http.Request, fd io.ReadSeeker, saved []*checksum) error {
+
+	a := getWantedDigest(r)
+	if a == nil {
+		return nil
+	}
+
+	if chk := findChecksum(saved, a.typ); chk != nil {
+		digest, err := encodeDigest(a, chk)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Digest", digest)
+		return nil
+	}
+
+	hashers, err := hashContents(fd, a.typ)
+	if err != nil {
+		return err
+	}
+
+	digest, err := encodeDigest(a, hashers.get(a.typ))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Digest", digest)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// errPreconditionFailed is returned when the preconditions of a change
+// do not hold when it is applied.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// getETag returns the entity tag for a file.
+// The tag is derived from the modification time and the size of the file
+// so it changes every time the file is overwritten.
+func getETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// getEncodedETag returns the entity tag for a file sent encoded with enc,
+// which must be different from the one of the decoded file.
+func getEncodedETag(info os.FileInfo, enc string) string {
+	return fmt.Sprintf(`"%x-%x-%s"`, info.ModTime().UnixNano(), info.Size(), enc)
+}
+
+// etagMatches reports if etag is present in the comma separated list
+// of entity tags found in a If-Match or If-None-Match header.
+// With weak comparison, used for If-None-Match, weak tags are compared
+// using their opaque part. With strong comparison, used for If-Match,
+// weak tags never match.
+func etagMatches(list, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPutPreconditions evaluates the If-Match and If-None-Match headers
+// of an upload against the current state of the target file.
+// info is nil when the target does not exist.
+// It returns false if the upload must be rejected with 412.
+func checkPutPreconditions(r *http.Request, info os.FileInfo) bool {
+	return checkPreconditions(r.Header.Get("If-Match"), r.Header.Get("If-None-Match"), info)
+}
+
+// checkPreconditions evaluates the values of the If-Match and If-None-Match
+// headers against the target file. Empty values are not evaluated.
+// info is nil when the target does not exist.
+func checkPreconditions(im, inm string, info os.FileInfo) bool {
+
+	if im != "" {
+		if info == nil {
+			return false
+		}
+		if !etagMatches(im, getETag(info), false) {
+			return false
+		}
+	}
+
+	if inm != "" {
+		if info != nil && etagMatches(inm, getETag(info), true) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pathLock serializes the changes of a path, so the preconditions
+// still hold when the change is applied.
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockPaths takes the locks of paths in order, so two changes of the
+// same paths cannot wait for each other.
+func (s *server) lockPaths(paths ...string) []string {
+
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+
+	locked := []string{}
+	for i, p := range sorted {
+		if i > 0 && p == sorted[i-1] {
+			continue
+		}
+		s.lockPath(p)
+		locked = append(locked, p)
+	}
+
+	return locked
+}
+
+// unlockPaths releases the locks taken with lockPaths.
+func (s *server) unlockPaths(locked []string) {
+	for _, p := range locked {
+		s.unlockPath(p)
+	}
+}
+
+// lockPath blocks until no other change holds the lock of p.
+func (s *server) lockPath(p string) {
+
+	s.pathsMu.Lock()
+	l, ok := s.pathLocks[p]
+	if !ok {
+		l = &pathLock{}
+		s.pathLocks[p] = l
+	}
+	l.refs++
+	s.pathsMu.Unlock()
+
+	l.mu.Lock()
+}
+
+// unlockPath releases the lock of p taken with lockPath.
+func (s *server) unlockPath(p string) {
+
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+
+	l := s.pathLocks[p]
+	l.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(s.pathLocks, p)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetETag(t *testing.T) {
+
+	now := time.Now()
+	a := &memoryFileInfo{"a", 5, now, false}
+
+	if getETag(a) != getETag(&memoryFileInfo{"b", 5, now, false}) {
+		t.Error("the tag depends on the name")
+	}
+	if getETag(a) == getETag(&memoryFileInfo{"a", 6, now, false}) {
+		t.Error("the tag does not depend on the size")
+	}
+	if getETag(a) == getETag(&memoryFileInfo{"a", 5, now.Add(time.Nanosecond), false}) {
+		t.Error("the tag does not depend on the modification time")
+	}
+	if getETag(a) == getEncodedETag(a, "gzip") {
+		t.Error("the tag of the encoded file is the one of the file")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+
+	tests := []struct {
+		list, etag string
+		weak, ok   bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`"b"`, `"a"`, false, false},
+		{`*`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`"a"`, `W/"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`W/"b"`, `"a"`, true, false},
+	}
+
+	for _, test := range tests {
+		if ok := etagMatches(test.list, test.etag, test.weak); ok != test.ok {
+			t.Errorf("etagMatches(%s, %s, %t) = %t, want %t",
+				test.list, test.etag, test.weak, ok, test.ok)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+
+	info := &memoryFileInfo{"a", 5, time.Now(), false}
+	etag := getETag(info)
+
+	tests := []struct {
+		name    string
+		im, inm string
+		exists  bool
+		ok      bool
+	}{
+		{"no headers", "", "", true, true},
+		{"if-match", etag, "", true, true},
+		{"if-match other", `"other"`, "", true, false},
+		{"if-match missing", "*", "", false, false},
+		{"if-none-match any", "", "*", true, false},
+		{"if-none-match any missing", "", "*", false, true},
+		{"if-none-match weak", "", "W/" + etag, true, false},
+		{"if-none-match other", "", `"other"`, true, true},
+	}
+
+	for _, test := range tests {
+		var fi os.FileInfo
+		if test.exists {
+			fi = info
+		}
+		if ok := checkPreconditions(test.im, test.inm, fi); ok != test.ok {
+			t.Errorf("%s: got %t, want %t", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestLockPaths(t *testing.T) {
+
+	s := &server{}
+	s.pathLocks = map[string]*pathLock{}
+
+	locked := s.lockPaths("/b", "/a", "/b")
+	if len(locked) != 2 || locked[0] != "/a" || locked[1] != "/b" {
+		t.Errorf("got locked paths %v, want /a and /b", locked)
+	}
+
+	// Other changes of the paths wait for the lock.
+	done := make(chan bool)
+	go func() {
+		s.lockPath("/b")
+		s.unlockPath("/b")
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("lock of /b taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.unlockPaths(locked)
+	<-done
+
+	if len(s.pathLocks) != 0 {
+		t.Errorf("%d locks left after unlocking", len(s.pathLocks))
+	}
+}
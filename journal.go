@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-data/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The journal is an append-only log kept in the tmp dir that records the
+// propagations to the propagator that have not been acknowledged yet.
+// An entry is appended before the data is changed, it is marked as applied
+// once the change is saved into the storage and as done once the propagator
+// saves it. Only applied entries are retried in the background, with
+// exponential backoff, and replayed when the service starts. Entries that
+// were never applied are discarded.
+//
+// The retries are sent with the token of the service, read from the
+// service token file, because the token of the user may have expired or
+// may not exist, like for pre-signed URLs. Without the service token the
+// retries use the token of the request saved in the entry.
+// Propagations that fail too many times are appended to the failed log
+// next to the journal and removed from it.
+
+const (
+	journalFile       = "propagator.journal"
+	journalFailedFile = "propagator.failed"
+
+	journalOpPut     = "put"
+	journalOpRm      = "rm"
+	journalOpMv      = "mv"
+	journalOpApplied = "applied"
+	journalOpDone    = "done"
+
+	minRetryBackoff = time.Second
+	maxRetryBackoff = 5 * time.Minute
+
+	// maxRetryAttempts is the number of retries before a propagation
+	// is given up.
+	maxRetryAttempts = 20
+)
+
+// errPropagationPending is returned when the data has been committed
+// but the propagator could not be reached. The propagation will be
+// retried in the background.
+var errPropagationPending = errors.New("propagation is pending")
+
+// errNoServiceToken is returned when a propagation needs the token of
+// the service but the service token file is not set.
+var errNoServiceToken = errors.New("service token file not set")
+
+// errNoToken is returned when a propagation has neither the token of the
+// service nor the token of the request.
+var errNoToken = errors.New("no token to propagate")
+
+type journalEntry struct {
+	Op       string `json:"op"`
+	ID       string `json:"id"`
+	TraceID  string `json:"trace_id,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	TmpFn    string `json:"tmp_fn,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	// applied is set once the change is saved into the storage.
+	// Entries are only retried if they are applied and nextTry is set.
+	applied  bool
+	attempts int
+	nextTry  time.Time
+}
+
+// failedPropagation is an entry of the failed log.
+type failedPropagation struct {
+	*journalEntry
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+type journal struct {
+	mu       sync.Mutex
+	fd       *os.File
+	failedFn string
+	pending  map[string]*journalEntry
+}
+
+// newJournal opens the journal at fn replaying the entries found in it.
+// The file is compacted so it only contains the pending entries.
+// Failed propagations are appended to failedFn.
+func newJournal(fn, failedFn string) (*journal, error) {
+
+	j := &journal{}
+	j.failedFn = failedFn
+	j.pending = map[string]*journalEntry{}
+
+	if err := j.replay(fn); err != nil {
+		return nil, err
+	}
+
+	// Rewrite the journal with only the pending entries.
+	tmpFn := fn + ".compact"
+	fd, err := os.OpenFile(tmpFn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(fd)
+	for _, e := range j.pending {
+		if err := enc.Encode(e); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if err := enc.Encode(&journalEntry{Op: journalOpApplied, ID: e.ID}); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	fd.Close()
+
+	if err := os.Rename(tmpFn, fn); err != nil {
+		return nil, err
+	}
+
+	fd, err = os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.fd = fd
+
+	return j, nil
+}
+
+func (j *journal) replay(fn string) error {
+
+	fd, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &journalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// A torn write at the end of the log after a crash.
+			log.Warnf("skipping corrupted journal entry: %s", err)
+			continue
+		}
+
+		switch e.Op {
+		case journalOpPut, journalOpRm, journalOpMv:
+			j.pending[e.ID] = e
+		case journalOpApplied:
+			if pe, ok := j.pending[e.ID]; ok {
+				pe.applied = true
+			}
+		case journalOpDone:
+			delete(j.pending, e.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for id, e := range j.pending {
+		// The service stopped before or while the change was saved,
+		// so it is not known to have happened.
+		if !e.applied {
+			log.Warnf("discarding propagation of %s %s because it was never applied",
+				e.Op, e.Path)
+			if e.TmpFn != "" {
+				os.Remove(e.TmpFn)
+			}
+			delete(j.pending, id)
+			continue
+		}
+		log.Infof("replaying propagation of %s %s", e.Op, e.Path)
+		e.nextTry = time.Now()
+	}
+
+	return nil
+}
+
+// add records a pending propagation and returns its ID.
+// e.Op must be set by the caller.
+func (j *journal) add(e *journalEntry) (string, error) {
+
+	_uuid, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	e.ID = _uuid.String()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(e); err != nil {
+		return "", err
+	}
+
+	// The entry is not retried until it is applied and the first
+	// attempt, made by the caller, fails.
+	j.pending[e.ID] = e
+
+	return e.ID, nil
+}
+
+// apply marks the propagation e as applied.
+func (j *journal) apply(e *journalEntry) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// The entry is retried while running even if it cannot be recorded.
+	e.applied = true
+	return j.write(&journalEntry{Op: journalOpApplied, ID: e.ID})
+}
+
+// retry schedules the propagation e to be retried in the background.
+func (j *journal) retry(e *journalEntry) {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.backoff(e)
+}
+
+// done marks the propagation with the given ID as finished.
+func (j *journal) done(id string) error {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(&journalEntry{Op: journalOpDone, ID: id}); err != nil {
+		return err
+	}
+
+	delete(j.pending, id)
+
+	// Nothing is pending so the log can be emptied.
+	if len(j.pending) == 0 {
+		return j.fd.Truncate(0)
+	}
+
+	return nil
+}
+
+// fail gives up the propagation e appending it to the failed log.
+func (j *journal) fail(e *journalEntry, reason error) error {
+
+	j.mu.Lock()
+	// The token of the request is not kept in the failed log.
+	fe := *e
+	fe.Token = ""
+	fp := &failedPropagation{&fe, e.attempts + 1, reason.Error(), time.Now()}
+	data, err := json.Marshal(fp)
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(j.failedFn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(append(data, '\n'))
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return j.done(e.ID)
+}
+
+func (j *journal) backoff(e *journalEntry) {
+
+	d := minRetryBackoff << uint(e.attempts)
+	if d > maxRetryBackoff || d <= 0 {
+		d = maxRetryBackoff
+	}
+
+	e.attempts++
+	e.nextTry = time.Now().Add(d)
+}
+
+func (j *journal) write(e *journalEntry) error {
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.fd.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return j.fd.Sync()
+}
+
+// due returns the pending entries that must be retried now.
+func (j *journal) due() []*journalEntry {
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	entries := []*journalEntry{}
+	for _, e := range j.pending {
+		if e.applied && !e.nextTry.IsZero() && !e.nextTry.After(now) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// journaled records e in the journal, applies op and propagates e.
+// op is applied holding the locks of the paths of e, which are released
+// before propagating.
+// If op fails the entry is discarded. If the propagator cannot be reached
+// errPropagationPending is returned and the propagation is retried
+// in the background.
+func (s *server) journaled(ctx context.Context, e *journalEntry, op func() error) error {
+
+	log := MustFromLogContext(ctx)
+
+	e.TraceID = getTraceIDFromContext(ctx)
+	e.Token, _ = authlib.FromTokenContext(ctx)
+
+	id, err := s.journal.add(e)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("recorded propagation %s of %s %s in journal", id, e.Op, e.Path)
+
+	paths := []string{e.Path}
+	if e.Dst != "" {
+		paths = append(paths, e.Dst)
+	}
+	locked := s.lockPaths(paths...)
+
+	if err := op(); err != nil {
+		s.unlockPaths(locked)
+		if err := s.journal.done(id); err != nil {
+			log.Error(err)
+		}
+		return err
+	}
+
+	// The change is saved, so it must be propagated even if the
+	// journal cannot record it.
+	if err := s.journal.apply(e); err != nil {
+		log.Error(err)
+	}
+
+	s.unlockPaths(locked)
+
+	if err := s.propagate(ctx, e); err != nil {
+		log.Errorf("cannot propagate %s %s, will retry later: %s", e.Op, e.Path, err)
+		s.journal.retry(e)
+		return errPropagationPending
+	}
+
+	log.Infof("propagated %s %s into %s", e.Op, e.Path, s.p.prop)
+
+	if err := s.journal.done(id); err != nil {
+		log.Error(err)
+	}
+
+	return nil
+}
+
+// getServiceToken returns the token of the service. The service token
+// file is read every time, so the token can be renewed while running.
+func (s *server) getServiceToken() (string, error) {
+
+	if s.p.svcTokenFile == "" {
+		return "", errNoServiceToken
+	}
+
+	data, err := ioutil.ReadFile(s.p.svcTokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("empty service token in %s", s.p.svcTokenFile)
+	}
+
+	return token, nil
+}
+
+// getPropagatorToken returns the token sent to the propagator for e: the
+// token of the service or, if it is not set, the token of the request
+// saved in e.
+func (s *server) getPropagatorToken(e *journalEntry) (string, error) {
+
+	token, err := s.getServiceToken()
+	if err != errNoServiceToken {
+		return token, err
+	}
+
+	if e.Token != "" {
+		return e.Token, nil
+	}
+
+	return "", errNoToken
+}
+
+// propagate sends the operation recorded in e to the propagator.
+func (s *server) propagate(ctx context.Context, e *journalEntry) error {
+
+	token, err := s.getPropagatorToken(e)
+	if err != nil {
+		return err
+	}
+
+	con, err := grpc.Dial(s.p.prop, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	client := pb.NewPropClient(con)
+
+	// Without a deadline the call blocks until the propagator is back.
+	ctx, cancel := context.WithTimeout(ctx, propagatorTimeout)
+	defer cancel()
+
+	switch e.Op {
+	case journalOpPut:
+		in := &pb.PutReq{}
+		in.Path = e.Path
+		in.AccessToken = token
+		in.Checksum = e.Checksum
+		_, err = client.Put(ctx, in)
+	case journalOpRm:
+		in := &pb.RmReq{}
+		in.Path = e.Path
+		in.AccessToken = token
+		_, err = client.Rm(ctx, in)
+	case journalOpMv:
+		in := &pb.MvReq{}
+		in.Src = e.Path
+		in.Dst = e.Dst
+		in.AccessToken = token
+		_, err = client.Mv(ctx, in)
+	default:
+		err = fmt.Errorf("unknown journal operation %q", e.Op)
+	}
+
+	return err
+}
+
+// retryPropagations retries the pending propagations of the journal
+// until they succeed or fail too many times.
+func (s *server) retryPropagations() {
+
+	ticker := time.NewTicker(minRetryBackoff)
+	defer ticker.Stop()
+
+	for range ticker.C {
+
+		for _, e := range s.journal.due() {
+
+			reqLogger := log.WithField("trace", e.TraceID)
+			ctx := newGRPCTraceContext(context.Background(), e.TraceID)
+
+			if err := s.propagate(ctx, e); err != nil {
+				if err == errNoToken || e.attempts+1 >= maxRetryAttempts {
+					reqLogger.Errorf("giving up propagation of %s %s after %d attempts: %s",
+						e.Op, e.Path, e.attempts+1, err)
+					if err := s.journal.fail(e, err); err != nil {
+						reqLogger.Error(err)
+					}
+					continue
+				}
+				reqLogger.Errorf("cannot propagate %s: %s", e.Path, err)
+				s.journal.retry(e)
+				continue
+			}
+
+			if err := s.journal.done(e.ID); err != nil {
+				reqLogger.Error(err)
+				continue
+			}
+
+			reqLogger.Infof("propagated %s", e.Path)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uncommitted := newTestTmpFile(t, "data")
+	defer os.Remove(uncommitted)
+
+	applied := newTestTmpFile(t, "data")
+	defer os.Remove(applied)
+	lines := []string{
+		`{"op":"put","id":"1","path":"/a","tmp_fn":"` + applied + `"}`,
+		`{"op":"applied","id":"1"}`,
+		`{"op":"put","id":"2","path":"/b","tmp_fn":"` + uncommitted + `"}`,
+		`{"op":"rm","id":"3","path":"/c"}`,
+		`{"op":"applied","id":"3"}`,
+		`{"op":"done","id":"3"}`,
+		`{"op":"mv","id":"4","path":"/d","dst":"/e"}`,
+		`{"op":"applied","id":"4"}`,
+		`{"op":"rm","id":"5","path":"/f"}`,
+		`{"op":"put","id":"6","pa`,
+	}
+	fn := dir + "/" + journalFile
+	if err := ioutil.WriteFile(fn, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := newJournal(fn, dir+"/"+journalFailedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.fd.Close()
+
+	// Only the applied entries are replayed.
+	if len(j.pending) != 2 || j.pending["1"] == nil || j.pending["4"] == nil {
+		t.Errorf("got pending entries %v, want 1 and 4", j.pending)
+	}
+	if len(j.due()) != 2 {
+		t.Errorf("replayed entries are not due")
+	}
+	if _, err := os.Stat(uncommitted); !os.IsNotExist(err) {
+		t.Error("tmp file of an upload never applied not removed")
+	}
+
+	// The journal is compacted.
+	fd, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	n := 0
+	for scanner := bufio.NewScanner(fd); scanner.Scan(); n++ {
+	}
+	if n != 4 {
+		t.Errorf("compacted journal has %d lines, want 4", n)
+	}
+
+	// The compacted journal replays the same entries.
+	j2, err := newJournal(fn, dir+"/"+journalFailedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.fd.Close()
+	if len(j2.due()) != 2 {
+		t.Errorf("got %d pending entries after compaction, want 2", len(j2.due()))
+	}
+}
+
+// waitFor fails if cond is not true after some seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+// getPending returns the number of pending propagations of s.
+func getPending(s *server) int {
+	s.journal.mu.Lock()
+	defer s.journal.mu.Unlock()
+	return len(s.journal.pending)
+}
+
+func TestPropagationRetries(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+
+	te.prop.setDown(true)
+	te.expect(http.StatusAccepted, "PUT", testHome+"/a", tk, "data", nil)
+	te.expect(http.StatusAccepted, "PUT", testHome+"/b", tk, "data", nil)
+
+	if n := getPending(te.s); n != 2 {
+		t.Fatalf("%d pending propagations, want 2", n)
+	}
+
+	// b fails too many times while a waits.
+	te.s.journal.mu.Lock()
+	for _, e := range te.s.journal.pending {
+		if strings.HasSuffix(e.Path, "/b") {
+			e.attempts = maxRetryAttempts - 1
+			e.nextTry = time.Now()
+		} else {
+			e.nextTry = time.Now().Add(time.Hour)
+		}
+	}
+	te.s.journal.mu.Unlock()
+
+	waitFor(t, "failed propagation", func() bool { return getPending(te.s) == 1 })
+
+	data, err := ioutil.ReadFile(te.dir + "/" + journalFailedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &failedPropagation{journalEntry: &journalEntry{}}
+	if err := json.Unmarshal(data, fp); err != nil {
+		t.Fatal(err)
+	}
+	if fp.Path != testHome+"/b" || fp.Attempts != maxRetryAttempts {
+		t.Errorf("got failed propagation %s after %d attempts", fp.Path, fp.Attempts)
+	}
+	if fp.Token != "" {
+		t.Error("token of the request saved in the failed log")
+	}
+
+	// a is retried with the token of the service.
+	te.prop.setDown(false)
+	te.s.journal.mu.Lock()
+	for _, e := range te.s.journal.pending {
+		e.nextTry = time.Now()
+	}
+	te.s.journal.mu.Unlock()
+
+	waitFor(t, "retried propagation", func() bool { return getPending(te.s) == 0 })
+
+	ops := te.prop.getOps()
+	if len(ops) != 1 || ops[0] != "put "+testHome+"/a" {
+		t.Errorf("got propagations %v", ops)
+	}
+	if tokens := te.prop.getTokens(); tokens[0] != testServiceToken {
+		t.Errorf("propagated with token %q, want the service token", tokens[0])
+	}
+}
+
+func TestPropagationWithRequestToken(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.svcTokenFile = ""
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/a", tk, "data", nil)
+
+	if tokens := te.prop.getTokens(); len(tokens) != 1 || tokens[0] != tk {
+		t.Errorf("got tokens %v, want the token of the request", tokens)
+	}
+}
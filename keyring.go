@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every user has a random data key that encrypts the files of the user.
+// Data keys are saved in the storage in /keys/<letter>/<pid> wrapped
+// (encrypted) by a master key. Master keys are kept in a local keyfile:
+//
+// {"current": "<id>", "keys": {"<id>": "<base64 encoded 32 byte key>"}}
+//
+// New data keys are wrapped with the current master key. Rotating the
+// master key only wraps the data keys again, the files are not touched.
+
+const (
+	keysRoot = "/keys"
+
+	keySize = 32
+)
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// wrappedKey is a data key encrypted by the master key Master.
+type wrappedKey struct {
+	Master string `json:"master"`
+	Key    string `json:"key"`
+}
+
+type keyring struct {
+	fn      string
+	storage storage
+	tmpDir  string
+
+	mu      sync.Mutex
+	current string
+	masters map[string][]byte
+	keys    map[string][]byte
+}
+
+func newKeyring(fn string, st storage, tmpDir string) (*keyring, error) {
+
+	k := &keyring{}
+	k.fn = fn
+	k.storage = st
+	k.tmpDir = tmpDir
+	k.keys = map[string][]byte{}
+
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// getKey returns the data key of pid and creates it if it does not exist.
+func (k *keyring) getKey(pid string) ([]byte, error) {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.keys[pid]; ok {
+		return key, nil
+	}
+
+	wk, err := k.readWrappedKey(pid)
+	if os.IsNotExist(err) {
+		return k.createKey(pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := k.unwrap(pid, wk)
+	if err != nil {
+		return nil, err
+	}
+
+	k.keys[pid] = key
+	return key, nil
+}
+
+// createKey must be called with mu held.
+func (k *keyring) createKey(pid string) ([]byte, error) {
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	wk, err := k.wrap(pid, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.writeWrappedKey(pid, wk); err != nil {
+		return nil, err
+	}
+
+	log.Infof("created data key for %s", pid)
+
+	k.keys[pid] = key
+	return key, nil
+}
+
+// wrap encrypts key with the current master key.
+// The pid is authenticated, so a wrapped key cannot be used for
+// other user.
+func (k *keyring) wrap(pid string, key []byte) (*wrappedKey, error) {
+
+	aead, err := newGCM(k.masters[k.current])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, key, []byte(pid))
+
+	return &wrappedKey{k.current, base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+func (k *keyring) unwrap(pid string, wk *wrappedKey) ([]byte, error) {
+
+	master, ok := k.masters[wk.Master]
+	if !ok {
+		// The key could have been rotated by other process.
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+		master, ok = k.masters[wk.Master]
+		if !ok {
+			return nil, fmt.Errorf("unknown master key %q for %s", wk.Master, pid)
+		}
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wk.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupted data key for %s", pid)
+	}
+
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(pid))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key for %s: %s", pid, err)
+	}
+
+	return key, nil
+}
+
+func (k *keyring) readWrappedKey(pid string) (*wrappedKey, error) {
+
+	fd, err := k.storage.Open(getKeyPath(pid))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	wk := &wrappedKey{}
+	if err := json.NewDecoder(fd).Decode(wk); err != nil {
+		return nil, fmt.Errorf("corrupted data key for %s: %s", pid, err)
+	}
+
+	return wk, nil
+}
+
+func (k *keyring) writeWrappedKey(pid string, wk *wrappedKey) error {
+
+	p := getKeyPath(pid)
+	if err := storageMkdirAll(k.storage, path.Dir(p)); err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(k.tmpDir, serviceID)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fd).Encode(wk)
+	fd.Close()
+	if err == nil {
+		err = k.storage.Commit(fd.Name(), p)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	return nil
+}
+
+// load reads the master keys from the keyfile.
+func (k *keyring) load() error {
+
+	kf, err := readKeyFile(k.fn)
+	if err != nil {
+		return err
+	}
+
+	masters := map[string][]byte{}
+	for id, v := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("invalid master key %q: %s", id, err)
+		}
+		if len(key) != keySize {
+			return fmt.Errorf("master key %q must be %d bytes", id, keySize)
+		}
+		masters[id] = key
+	}
+
+	if _, ok := masters[kf.Current]; !ok {
+		return fmt.Errorf("current master key %q not found in %s", kf.Current, k.fn)
+	}
+
+	k.current = kf.Current
+	k.masters = masters
+	return nil
+}
+
+// rotateMasterKey adds a new master key to the keyfile, makes it the
+// current one and wraps all the data keys with it.
+// If the keyfile does not exist it is created.
+//
+// The previous master keys are kept in the keyfile, so servers that
+// have not loaded the new key yet can still wrap and unwrap keys.
+func rotateMasterKey(p *newServerParams) error {
+
+	kf, err := readKeyFile(p.keyFile)
+	if os.IsNotExist(err) {
+		kf = &keyFile{Keys: map[string]string{}}
+	} else if err != nil {
+		return err
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	kf.Current = strconv.FormatInt(time.Now().UnixNano(), 10)
+	kf.Keys[kf.Current] = base64.StdEncoding.EncodeToString(key)
+
+	// The keyfile is saved first, so the data keys are never wrapped
+	// by a master key that is not saved.
+	if err := writeKeyFile(p.keyFile, kf); err != nil {
+		return err
+	}
+
+	log.Infof("added master key %s to %s", kf.Current, p.keyFile)
+
+	st, err := newStorage(p)
+	if err != nil {
+		return err
+	}
+
+	k, err := newKeyring(p.keyFile, st, p.tmpDir)
+	if err != nil {
+		return err
+	}
+
+	// /keys/<letter>/<pid>
+	letters, err := st.ReadDir(keysRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rotated int
+	for _, letter := range letters {
+		pids, err := st.ReadDir(path.Join(keysRoot, letter.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, info := range pids {
+			pid := info.Name()
+
+			wk, err := k.readWrappedKey(pid)
+			if err != nil {
+				return err
+			}
+
+			if wk.Master == k.current {
+				continue
+			}
+
+			key, err := k.unwrap(pid, wk)
+			if err != nil {
+				return err
+			}
+
+			wk, err = k.wrap(pid, key)
+			if err != nil {
+				return err
+			}
+
+			if err := k.writeWrappedKey(pid, wk); err != nil {
+				return err
+			}
+
+			rotated++
+		}
+	}
+
+	log.Infof("wrapped %d data keys with master key %s", rotated, kf.Current)
+
+	return nil
+}
+
+func readKeyFile(fn string) (*keyFile, error) {
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &keyFile{}
+	if err := json.Unmarshal(data, kf); err != nil {
+		return nil, fmt.Errorf("invalid keyfile %s: %s", fn, err)
+	}
+
+	return kf, nil
+}
+
+// writeKeyFile replaces the keyfile fn atomically.
+func writeKeyFile(fn string, kf *keyFile) error {
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFn := fn + ".tmp"
+	if err := ioutil.WriteFile(tmpFn, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFn, fn)
+}
+
+// getKeyPath returns the path where the data key of pid is saved.
+func getKeyPath(pid string) string {
+	pid = path.Clean(pid)
+	return path.Join(keysRoot, string(pid[0]), pid)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
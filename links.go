@@ -0,0 +1,610 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Public links give access to a file or a directory of a home to anyone
+// knowing their token, without a token of the user. They are kept in the
+// links file of the tmp dir.
+//
+// Links are read-only or upload-only. Read-only links download the file
+// or the files below the directory with GET and HEAD requests.
+// Upload-only links, the drop boxes, create new files below the directory
+// with PUT requests but cannot read or replace them. Uploads to paths that
+// exist are refused with 409, or with 412 if the path is created by another
+// upload while the file is received.
+//
+// Links can expire, can be protected with a password sent as the password
+// of the Basic authentication, and can limit the number of downloads.
+// Every GET request of a file on a read-only link counts as a download,
+// listing a directory does not.
+//
+// GET /links lists the links of the user.
+// POST /links?path=<path>&mode=<read|upload>&expires_in=<seconds>
+// &max_downloads=<n> creates a link. The password is sent in the
+// password field of the form in the body.
+// DELETE /links/<id> removes a link.
+//
+// GET, HEAD and PUT /public/<token>/<path> access the path below the link.
+//
+// Requests with public links are served on behalf of the owner of the
+// home, so only paths inside the home of the user can be linked. The idp
+// of the user is kept with the link.
+
+const (
+	linksEndPoint  = "/links"
+	publicEndPoint = "/public"
+	linksFile      = "links"
+
+	linkModeRead   = "read"
+	linkModeUpload = "upload"
+
+	// linkHashRounds is the number of rounds used to hash the passwords.
+	linkHashRounds = 10000
+)
+
+type link struct {
+	ID           string `json:"id"`
+	Token        string `json:"token"`
+	Path         string `json:"path"`
+	Idp          string `json:"idp"`
+	Mode         string `json:"mode"`
+	Created      int64  `json:"created"`
+	Expires      int64  `json:"expires"`
+	MaxDownloads int64  `json:"max_downloads"`
+	Downloads    int64  `json:"downloads"`
+	PasswordSalt string `json:"password_salt,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// linkInfo is a link as listed to its owner.
+type linkInfo struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	Path         string `json:"path"`
+	Mode         string `json:"mode"`
+	Created      int64  `json:"created"`
+	Expires      int64  `json:"expires"`
+	MaxDownloads int64  `json:"max_downloads"`
+	Downloads    int64  `json:"downloads"`
+	HasPassword  bool   `json:"has_password"`
+}
+
+func (l *link) getInfo() *linkInfo {
+	info := &linkInfo{}
+	info.ID = l.ID
+	info.URL = path.Join(publicEndPoint, l.Token)
+	info.Path = l.Path
+	info.Mode = l.Mode
+	info.Created = l.Created
+	info.Expires = l.Expires
+	info.MaxDownloads = l.MaxDownloads
+	info.Downloads = l.Downloads
+	info.HasPassword = l.PasswordHash != ""
+	return info
+}
+
+func (l *link) isExpired() bool {
+	return l.Expires > 0 && time.Now().Unix() > l.Expires
+}
+
+// setPassword saves the salted hash of password.
+func (l *link) setPassword(password string) error {
+	salt, err := newRandomHex(16)
+	if err != nil {
+		return err
+	}
+	l.PasswordSalt = salt
+	l.PasswordHash = hashLinkPassword(salt, password)
+	return nil
+}
+
+// checkPassword reports if password is the password of l. Links without
+// password accept any.
+func (l *link) checkPassword(password string) bool {
+	if l.PasswordHash == "" {
+		return true
+	}
+	hash := hashLinkPassword(l.PasswordSalt, password)
+	return hmac.Equal([]byte(hash), []byte(l.PasswordHash))
+}
+
+// hashLinkPassword hashes password with salt in several rounds to slow
+// down guessing.
+func hashLinkPassword(salt, password string) string {
+	sum := []byte(password)
+	for i := 0; i < linkHashRounds; i++ {
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write(sum)
+		sum = mac.Sum(nil)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// newRandomHex returns n random bytes in hexadecimal.
+func newRandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type linkStore struct {
+	mu    sync.Mutex
+	fn    string
+	links map[string]*link
+}
+
+// newLinkStore returns a store with the links saved in fn.
+func newLinkStore(fn string) (*linkStore, error) {
+
+	ls := &linkStore{}
+	ls.fn = fn
+	ls.links = map[string]*link{}
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return ls, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	links := []*link{}
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		ls.links[l.ID] = l
+	}
+
+	return ls, nil
+}
+
+// add saves a new link.
+func (ls *linkStore) add(l *link) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.links[l.ID] = l
+	return ls.save()
+}
+
+// remove removes the link id of the home of idt. It reports false
+// if there is no such link.
+func (ls *linkStore) remove(idt *authlib.Identity, id string) (bool, error) {
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.links[id]
+	if !ok || !isUnderHome(l.Path, idt) {
+		return false, nil
+	}
+
+	delete(ls.links, id)
+	return true, ls.save()
+}
+
+// list returns the links of the home of idt sorted by creation time.
+func (ls *linkStore) list(idt *authlib.Identity) []*linkInfo {
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	infos := []*linkInfo{}
+	for _, l := range ls.links {
+		if isUnderHome(l.Path, idt) {
+			infos = append(infos, l.getInfo())
+		}
+	}
+
+	sort.Sort(byCreated(infos))
+	return infos
+}
+
+type byCreated []*linkInfo
+
+func (a byCreated) Len() int           { return len(a) }
+func (a byCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreated) Less(i, j int) bool { return a[i].Created < a[j].Created }
+
+// getByToken returns a copy of the link with token or nil.
+func (ls *linkStore) getByToken(token string) *link {
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, l := range ls.links {
+		if hmac.Equal([]byte(l.Token), []byte(token)) {
+			c := *l
+			return &c
+		}
+	}
+
+	return nil
+}
+
+// countDownload adds a download to the link id. It reports false if
+// the link reached its maximum number of downloads or was removed.
+func (ls *linkStore) countDownload(id string) (bool, error) {
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	l, ok := ls.links[id]
+	if !ok {
+		return false, nil
+	}
+
+	if l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads {
+		return false, nil
+	}
+
+	l.Downloads++
+	return true, ls.save()
+}
+
+// save writes the links into their file. It must be called with
+// the lock held.
+func (ls *linkStore) save() error {
+
+	links := []*link{}
+	for _, l := range ls.links {
+		links = append(links, l)
+	}
+
+	data, err := json.Marshal(links)
+	if err != nil {
+		return err
+	}
+
+	tmpFn := ls.fn + ".tmp"
+	if err := ioutil.WriteFile(tmpFn, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFn, ls.fn)
+}
+
+// isPublicPath reports if p is a path of a public link.
+func isPublicPath(p string) bool {
+	return strings.HasPrefix(p, publicEndPoint+"/")
+}
+
+// linksHandler handles the requests to the links endpoint.
+func (s *server) linksHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	id := strings.TrimPrefix(strings.TrimPrefix(getPathFromReq(r), linksEndPoint), "/")
+
+	// Links are listed and removed for the whole home.
+	if strings.ToUpper(r.Method) != "POST" {
+		if err := checkHomeScope(ctx, r.Method); err != nil {
+			log.Warn(err)
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch {
+	case strings.ToUpper(r.Method) == "GET" && id == "":
+		log.WithField("op", "list-links").Info()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.links.list(idt)); err != nil {
+			log.Error(err)
+		}
+	case strings.ToUpper(r.Method) == "POST" && id == "":
+		log.WithField("op", "create-link").Info()
+		s.createLink(ctx, w, r)
+	case strings.ToUpper(r.Method) == "DELETE" && id != "":
+		log.WithField("op", "remove-link").Info()
+		found, err := s.links.remove(idt, id)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			log.Errorf("link %s not found", id)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		log.Infof("removed link %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) createLink(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	q := r.URL.Query()
+
+	l := &link{}
+	l.Path = path.Clean("/" + q.Get("path"))
+
+	if !isUnderHome(l.Path, idt) || l.Path == getHome(idt) {
+		log.Warnf("%s cannot link %s", *idt, l.Path)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	info, err := s.storage.Stat(l.Path)
+	if os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	l.Mode = q.Get("mode")
+	if l.Mode == "" {
+		l.Mode = linkModeRead
+	}
+	if l.Mode != linkModeRead && l.Mode != linkModeUpload {
+		log.Errorf("unknown link mode %q", l.Mode)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if l.Mode == linkModeUpload && !info.IsDir() {
+		log.Errorf("upload links must point to a directory, %s is a file", l.Path)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if v := q.Get("expires_in"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || secs <= 0 {
+			log.Errorf("invalid expires_in %q", v)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		l.Expires = time.Now().Add(time.Duration(secs) * time.Second).Unix()
+	}
+
+	if v := q.Get("max_downloads"); v != "" {
+		maxDownloads, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxDownloads <= 0 || l.Mode != linkModeRead {
+			log.Errorf("invalid max_downloads %q for %s link", v, l.Mode)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		l.MaxDownloads = maxDownloads
+	}
+
+	// The password is not taken from the URL to keep it out of the logs.
+	if password := r.PostFormValue("password"); password != "" {
+		if err := l.setPassword(password); err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Links cannot give more access than the token creating them.
+	method := "GET"
+	if l.Mode == linkModeUpload {
+		method = "PUT"
+	}
+	if err := checkScope(ctx, method, l.Path); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	id, err := newRandomHex(8)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	token, err := newRandomHex(16)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	l.ID = id
+	l.Token = token
+	l.Idp = idt.Idp
+	l.Created = time.Now().Unix()
+
+	if err := s.links.add(l); err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("link", l.ID).Infof("%s created %s link for %s", *idt, l.Mode, l.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(l.getInfo()); err != nil {
+		log.Error(err)
+	}
+}
+
+// linkHandler resolves the public link of the path of the request,
+// checks that the link allows the request and saves the owner of the
+// linked path as the identity into ctx. The request passed to next has
+// the path below the link.
+func (s *server) linkHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+
+	log := MustFromLogContext(ctx)
+
+	if s.links == nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	rel := strings.TrimPrefix(getPathFromReq(r), publicEndPoint+"/")
+	parts := strings.SplitN(rel, "/", 2)
+	token := parts[0]
+
+	l := s.links.getByToken(token)
+	if l == nil {
+		log.Warn("unknown link token")
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	// Every access is logged with the link ID.
+	log = log.WithField("link", l.ID)
+	ctx = NewLogContext(ctx, log)
+
+	if l.isExpired() {
+		log.Warnf("link expired at %s", time.Unix(l.Expires, 0).UTC().Format(time.RFC3339))
+		http.Error(w, "", http.StatusGone)
+		return
+	}
+
+	if _, password, _ := r.BasicAuth(); !l.checkPassword(password) {
+		log.Warn("wrong link password")
+		w.Header().Set("WWW-Authenticate", `Basic realm="link"`)
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	p := l.Path
+	if len(parts) == 2 {
+		p = path.Join(l.Path, parts[1])
+	}
+
+	if err := checkLinkAccess(r, l, p); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if l.Mode == linkModeUpload {
+		if _, err := s.storage.Stat(p); err == nil {
+			log.Errorf("%s already exists", p)
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+	}
+
+	if l.Mode == linkModeRead && strings.ToUpper(r.Method) == "GET" {
+		info, err := s.storage.Stat(p)
+		if os.IsNotExist(err) {
+			log.Error(err)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		// Listing a directory is not a download.
+		if !info.IsDir() {
+			ok, err := s.links.countDownload(l.ID)
+			if err != nil {
+				log.Error(err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				log.Warnf("link reached its maximum of %d downloads", l.MaxDownloads)
+				http.Error(w, "", http.StatusGone)
+				return
+			}
+		}
+	}
+
+	owner := getOwnerIdentity(p, l.Idp)
+	if owner == nil {
+		log.Warnf("%s is not inside a home or link %s has no idp", p, l.ID)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	log.Infof("public %s of %s on behalf of %s", strings.ToUpper(r.Method), p, *owner)
+
+	// The handlers take the path from the URL, so it is replaced with
+	// the linked one.
+	u := *r.URL
+	u.Path = p
+	lr := *r
+	lr.URL = &u
+
+	// Drop boxes cannot replace files, which is checked again by the
+	// upload holding the lock of the path.
+	if l.Mode == linkModeUpload {
+		lr.Header = http.Header{}
+		for name, values := range r.Header {
+			lr.Header[name] = values
+		}
+		lr.Header.Set("If-None-Match", "*")
+		lr.Header.Del("If-Match")
+	}
+
+	// There is no token, so shared paths cannot be resolved.
+	ctx = authlib.NewContext(ctx, owner)
+	ctx = authlib.NewTokenContext(ctx, "")
+	next(ctx, w, &lr)
+}
+
+// checkLinkAccess checks that l allows the request r on p.
+// Query params could change what the request does, like version, so
+// only the ones needed to upload are allowed.
+func checkLinkAccess(r *http.Request, l *link, p string) error {
+
+	method := strings.ToUpper(r.Method)
+
+	switch l.Mode {
+	case linkModeRead:
+		if method != "GET" && method != "HEAD" {
+			return fmt.Errorf("%s not allowed with read-only link", method)
+		}
+		if len(r.URL.Query()) > 0 {
+			return fmt.Errorf("query params not allowed with read-only link")
+		}
+	case linkModeUpload:
+		if method != "PUT" {
+			return fmt.Errorf("%s not allowed with upload-only link", method)
+		}
+		if p == l.Path {
+			return fmt.Errorf("upload-only link needs a path below %s", l.Path)
+		}
+		for name := range r.URL.Query() {
+			if name != "create_parents" && name != "checksum" {
+				return fmt.Errorf("query param %q not allowed with upload-only link", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown link mode %q", l.Mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newLinksTestEnv(t *testing.T) *testEnv {
+	return newTestEnv(t, func(p *newServerParams) {
+		p.links = true
+	})
+}
+
+// createLink creates a link to p with the params and the password,
+// if not empty.
+func (te *testEnv) createLink(token, p string, params url.Values, password string) *linkInfo {
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("path", p)
+
+	body := url.Values{"password": {password}}.Encode()
+	w := te.expect(http.StatusCreated, "POST", linksEndPoint+"?"+params.Encode(), token, body,
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+
+	info := &linkInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		te.t.Fatal(err)
+	}
+	return info
+}
+
+func TestReadLink(t *testing.T) {
+
+	te := newLinksTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	dir := testHome + "/d"
+	te.expect(http.StatusCreated, "MKCOL", dir, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", dir+"/a.txt", tk, "hello", nil)
+
+	l := te.createLink(tk, dir, url.Values{"max_downloads": {"2"}}, "")
+
+	// Listing the directory is not a download.
+	for i := 0; i < 3; i++ {
+		if w := te.do("GET", l.URL, "", "", nil); w.Code == http.StatusGone {
+			t.Fatal("GET of the directory counted as a download")
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		w := te.expect(http.StatusOK, "GET", l.URL+"/a.txt", "", "", nil)
+		if w.Body.String() != "hello" {
+			t.Errorf("got %q, want %q", w.Body.String(), "hello")
+		}
+	}
+	te.expect(http.StatusGone, "GET", l.URL+"/a.txt", "", "", nil)
+
+	// Read-only links cannot change the files.
+	l = te.createLink(tk, dir, nil, "")
+	te.expect(http.StatusForbidden, "PUT", l.URL+"/a.txt", "", "bye", nil)
+	te.expect(http.StatusForbidden, "DELETE", l.URL+"/a.txt", "", "", nil)
+
+	// Paths escaping the link are not public.
+	te.expect(http.StatusUnauthorized, "GET", l.URL+"/../../b/bob", "", "", nil)
+
+	te.expect(http.StatusNoContent, "DELETE", linksEndPoint+"/"+l.ID, tk, "", nil)
+	te.expect(http.StatusNotFound, "GET", l.URL+"/a.txt", "", "", nil)
+
+	// Only paths inside the home can be linked.
+	q := url.Values{"path": {dir}}
+	te.expect(http.StatusForbidden, "POST", linksEndPoint+"?"+q.Encode(), newTestToken("bob", nil), "", nil)
+}
+
+func TestLinkPassword(t *testing.T) {
+
+	te := newLinksTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+	te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+
+	l := te.createLink(tk, p, nil, "secret")
+	if !l.HasPassword {
+		t.Error("link without password")
+	}
+
+	basic := func(password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " +
+			base64.StdEncoding.EncodeToString([]byte(":"+password))}
+	}
+	te.expect(http.StatusUnauthorized, "GET", l.URL, "", "", nil)
+	te.expect(http.StatusUnauthorized, "GET", l.URL, "", "", basic("other"))
+	te.expect(http.StatusOK, "GET", l.URL, "", "", basic("secret"))
+}
+
+func TestDropBox(t *testing.T) {
+
+	te := newLinksTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	dir := testHome + "/inbox"
+	te.expect(http.StatusCreated, "MKCOL", dir, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", dir+"/a.txt", tk, "mine", nil)
+
+	l := te.createLink(tk, dir, url.Values{"mode": {linkModeUpload}}, "")
+
+	te.expect(http.StatusCreated, "PUT", l.URL+"/b.txt", "", "dropped", nil)
+
+	// Files cannot be read or replaced, even with If-Match.
+	te.expect(http.StatusForbidden, "GET", l.URL+"/b.txt", "", "", nil)
+	te.expect(http.StatusConflict, "PUT", l.URL+"/a.txt", "", "replaced", nil)
+	te.expect(http.StatusConflict, "PUT", l.URL+"/a.txt", "", "replaced", map[string]string{"If-Match": "*"})
+
+	w := te.expect(http.StatusOK, "GET", dir+"/a.txt", tk, "", nil)
+	if w.Body.String() != "mine" {
+		t.Errorf("got %q, want %q", w.Body.String(), "mine")
+	}
+	w = te.expect(http.StatusOK, "GET", dir+"/b.txt", tk, "", nil)
+	if w.Body.String() != "dropped" {
+		t.Errorf("got %q, want %q", w.Body.String(), "dropped")
+	}
+
+	// Upload links can only point to directories.
+	q := url.Values{"path": {dir + "/a.txt"}, "mode": {linkModeUpload}}
+	te.expect(http.StatusBadRequest, "POST", linksEndPoint+"?"+q.Encode(), tk, "", nil)
+}
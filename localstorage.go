@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// xattrPrefix is the namespace of the extended attributes
+// that can be set by unprivileged processes.
+const xattrPrefix = "user."
+
+// localStorage saves the data in a directory of the local filesystem.
+type localStorage struct {
+	dataDir string
+}
+
+func newLocalStorage(dataDir string) *localStorage {
+	return &localStorage{dataDir: dataDir}
+}
+
+func (l *localStorage) Open(p string) (storageFile, error) {
+	fd, err := os.Open(l.getPhysicalPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (l *localStorage) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(l.getPhysicalPath(p))
+}
+
+func (l *localStorage) ReadDir(p string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(l.getPhysicalPath(p))
+}
+
+func (l *localStorage) Commit(tmpFn, p string) error {
+	return os.Rename(tmpFn, l.getPhysicalPath(p))
+}
+
+func (l *localStorage) Mkdir(p string) error {
+	return os.Mkdir(l.getPhysicalPath(p), dirPerm)
+}
+
+func (l *localStorage) Remove(p string) error {
+	return os.Remove(l.getPhysicalPath(p))
+}
+
+func (l *localStorage) RemoveAll(p string) error {
+	return os.RemoveAll(l.getPhysicalPath(p))
+}
+
+func (l *localStorage) Rename(src, dst string) error {
+	return os.Rename(l.getPhysicalPath(src), l.getPhysicalPath(dst))
+}
+
+// GetAttrs returns the extended attributes of p in the user namespace.
+// The user. prefix is removed from the names.
+func (l *localStorage) GetAttrs(p string) (map[string]string, error) {
+
+	xattrs, err := getXattrs(l.getPhysicalPath(p))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	for name, value := range xattrs {
+		if strings.HasPrefix(name, xattrPrefix) {
+			attrs[strings.TrimPrefix(name, xattrPrefix)] = value
+		}
+	}
+
+	return attrs, nil
+}
+
+// SetAttrs saves attrs as extended attributes of p in the user namespace.
+func (l *localStorage) SetAttrs(p string, attrs map[string]string) error {
+
+	fn := l.getPhysicalPath(p)
+	for name, value := range attrs {
+		if err := setXattr(fn, xattrPrefix+name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *localStorage) getPhysicalPath(p string) string {
+	return path.Join(l.dataDir, path.Clean(p))
+}
@@ -8,36 +8,103 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	serviceID         = "CLAWIO_LOCALFS_DATA"
-	dataDirEnvar      = serviceID + "_DATADIR"
-	tmpDirEnvar       = serviceID + "_TMPDIR"
-	checksumEnvar     = serviceID + "_CHECKSUM"
-	portEnvar         = serviceID + "_PORT"
-	logLevelEnvar     = serviceID + "_LOGLEVEL"
-	propEnvar         = serviceID + "_PROP"
-	sharedSecretEnvar = "CLAWIO_SHAREDSECRET"
+	serviceID          = "CLAWIO_LOCALFS_DATA"
+	dataDirEnvar       = serviceID + "_DATADIR"
+	tmpDirEnvar        = serviceID + "_TMPDIR"
+	checksumEnvar      = serviceID + "_CHECKSUM"
+	portEnvar          = serviceID + "_PORT"
+	logLevelEnvar      = serviceID + "_LOGLEVEL"
+	propEnvar          = serviceID + "_PROP"
+	backendEnvar       = serviceID + "_BACKEND"
+	maxUploadEnvar     = serviceID + "_MAXUPLOAD"
+	uploadAgeEnvar     = serviceID + "_UPLOADAGE"
+	quotaEnvar         = serviceID + "_QUOTA"
+	quotaFileEnvar     = serviceID + "_QUOTAFILE"
+	versionsEnvar      = serviceID + "_VERSIONS"
+	versionsAgeEnvar   = serviceID + "_VERSIONSAGE"
+	trashEnvar         = serviceID + "_TRASH"
+	trashAgeEnvar      = serviceID + "_TRASHAGE"
+	dedupEnvar         = serviceID + "_DEDUP"
+	keyFileEnvar       = serviceID + "_KEYFILE"
+	compressEnvar      = serviceID + "_COMPRESS"
+	verifyEnvar        = serviceID + "_VERIFY"
+	scrubIntervalEnvar = serviceID + "_SCRUBINTERVAL"
+	scrubRateEnvar     = serviceID + "_SCRUBRATE"
+	adminsEnvar        = serviceID + "_ADMINS"
+	shareEnvar         = serviceID + "_SHARE"
+	shareCacheEnvar    = serviceID + "_SHARECACHE"
+	shareFileEnvar     = serviceID + "_SHAREFILE"
+	presignKeyEnvar    = serviceID + "_PRESIGNKEY"
+	presignMaxAgeEnvar = serviceID + "_PRESIGNMAXAGE"
+	linksEnvar         = serviceID + "_LINKS"
+	jwtAlgsEnvar       = serviceID + "_JWTALGS"
+	jwksFileEnvar      = serviceID + "_JWKSFILE"
+	jwtAudienceEnvar   = serviceID + "_JWTAUDIENCE"
+	jwtIssuerEnvar     = serviceID + "_JWTISSUER"
+	jwtLeewayEnvar     = serviceID + "_JWTLEEWAY"
+	jwtRequireExpEnvar = serviceID + "_JWTREQUIREEXP"
+	svcTokenFileEnvar  = serviceID + "_SERVICETOKENFILE"
+	sharedSecretEnvar  = "CLAWIO_SHAREDSECRET"
 
 	endPoint = "/"
 )
 
 type environ struct {
-	dataDir      string
-	tmpDir       string
-	checksum     string
-	port         int
-	logLevel     string
-	prop         string
-	sharedSecret string
+	dataDir       string
+	tmpDir        string
+	checksums     []string
+	port          int
+	logLevel      string
+	prop          string
+	backend       string
+	maxUpload     int64
+	uploadAge     time.Duration
+	quota         int64
+	quotaFile     string
+	versions      int
+	versionsAge   time.Duration
+	trash         bool
+	trashAge      time.Duration
+	dedup         bool
+	keyFile       string
+	compress      bool
+	verify        string
+	scrubInterval time.Duration
+	scrubRate     int64
+	admins        []string
+	share         string
+	shareCache    time.Duration
+	shareFile     string
+	presignKey    string
+	presignMaxAge time.Duration
+	links         bool
+	jwtAlgs       []string
+	jwksFile      string
+	jwtAudience   string
+	jwtIssuer     string
+	jwtLeeway     time.Duration
+	jwtRequireExp bool
+	svcTokenFile  string
+	sharedSecret  string
 }
 
 func getEnviron() (*environ, error) {
 	e := &environ{}
 	e.dataDir = os.Getenv(dataDirEnvar)
 	e.tmpDir = os.Getenv(tmpDirEnvar)
-	e.checksum = os.Getenv(checksumEnvar)
+
+	// A comma separated list of checksum types.
+	checksums, err := getChecksumTypes(os.Getenv(checksumEnvar))
+	if err != nil {
+		return nil, err
+	}
+	e.checksums = checksums
+
 	port, err := strconv.Atoi(os.Getenv(portEnvar))
 	if err != nil {
 		return nil, err
@@ -46,16 +113,217 @@ func getEnviron() (*environ, error) {
 	e.logLevel = os.Getenv(logLevelEnvar)
 	e.sharedSecret = os.Getenv(sharedSecretEnvar)
 	e.prop = os.Getenv(propEnvar)
+	e.backend = os.Getenv(backendEnvar)
+
+	// No limit if not set
+	if v := os.Getenv(maxUploadEnvar); v != "" {
+		maxUpload, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e.maxUpload = maxUpload
+	}
+
+	// Upload sessions expire after a day if not set
+	e.uploadAge = defaultUploadAge
+	if v := os.Getenv(uploadAgeEnvar); v != "" {
+		uploadAge, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if uploadAge <= 0 {
+			return nil, fmt.Errorf("%s must be positive", uploadAgeEnvar)
+		}
+		e.uploadAge = uploadAge
+	}
+
+	// Unlimited if not set
+	if v := os.Getenv(quotaEnvar); v != "" {
+		quota, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e.quota = quota
+	}
+	e.quotaFile = os.Getenv(quotaFileEnvar)
+
+	// Versioning is disabled if not set
+	if v := os.Getenv(versionsEnvar); v != "" {
+		versions, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		e.versions = versions
+	}
+
+	// Versions do not expire if not set
+	if v := os.Getenv(versionsAgeEnvar); v != "" {
+		versionsAge, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.versionsAge = versionsAge
+	}
+
+	e.trash = os.Getenv(trashEnvar) == "true"
+
+	// Items in the trash do not expire if not set
+	if v := os.Getenv(trashAgeEnvar); v != "" {
+		trashAge, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.trashAge = trashAge
+	}
+
+	e.dedup = os.Getenv(dedupEnvar) == "true"
+
+	// Files are not encrypted if not set
+	e.keyFile = os.Getenv(keyFileEnvar)
+
+	e.compress = os.Getenv(compressEnvar) == "true"
+
+	// Files are not verified when downloaded if not set
+	verify, err := getVerifyMode(os.Getenv(verifyEnvar))
+	if err != nil {
+		return nil, err
+	}
+	e.verify = verify
+
+	// The storage is not scrubbed in the background if not set
+	if v := os.Getenv(scrubIntervalEnvar); v != "" {
+		scrubInterval, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.scrubInterval = scrubInterval
+	}
+
+	// Scrubbing is not rate limited if not set
+	if v := os.Getenv(scrubRateEnvar); v != "" {
+		scrubRate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e.scrubRate = scrubRate
+	}
+
+	// A comma separated list of <idp>/<pid> or <pid>.
+	for _, admin := range strings.Split(os.Getenv(adminsEnvar), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			e.admins = append(e.admins, admin)
+		}
+	}
+
+	// Only the homes are accessible if not set
+	e.share = os.Getenv(shareEnvar)
+
+	// Decisions are cached for 10 seconds if not set
+	e.shareCache = 10 * time.Second
+	if v := os.Getenv(shareCacheEnvar); v != "" {
+		shareCache, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.shareCache = shareCache
+	}
+
+	// Grants served by share-standin
+	e.shareFile = os.Getenv(shareFileEnvar)
+
+	// URLs are signed with the shared secret if not set
+	e.presignKey = os.Getenv(presignKeyEnvar)
+
+	// Pre-signed URLs are disabled if not set
+	if v := os.Getenv(presignMaxAgeEnvar); v != "" {
+		presignMaxAge, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.presignMaxAge = presignMaxAge
+	}
+
+	e.links = os.Getenv(linksEnvar) == "true"
+
+	// A comma separated list of algorithms, only HS256 if not set
+	jwtAlgs := os.Getenv(jwtAlgsEnvar)
+	if jwtAlgs == "" {
+		jwtAlgs = "HS256"
+	}
+	algs, err := getJWTAlgs(jwtAlgs)
+	if err != nil {
+		return nil, err
+	}
+	e.jwtAlgs = algs
+
+	// Only the shared secret verifies tokens if not set
+	e.jwksFile = os.Getenv(jwksFileEnvar)
+
+	// Not checked if not set
+	e.jwtAudience = os.Getenv(jwtAudienceEnvar)
+	e.jwtIssuer = os.Getenv(jwtIssuerEnvar)
+
+	// No clock skew allowed if not set
+	if v := os.Getenv(jwtLeewayEnvar); v != "" {
+		jwtLeeway, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		e.jwtLeeway = jwtLeeway
+	}
+
+	// Tokens without expiration time are accepted if not set
+	e.jwtRequireExp = os.Getenv(jwtRequireExpEnvar) == "true"
+
+	// Pending propagations are retried with the token of the request and
+	// the scrubber does not compare with the propagator if not set
+	e.svcTokenFile = os.Getenv(svcTokenFileEnvar)
+
+	// Pre-signed URLs and public links do not carry the token of a user,
+	// so their changes can only be propagated with the token of the service.
+	if e.svcTokenFile == "" && (e.presignMaxAge > 0 || e.links) {
+		return nil, fmt.Errorf("%s must be set to use pre-signed URLs or public links",
+			svcTokenFileEnvar)
+	}
 	return e, nil
 }
 
 func printEnviron(e *environ) {
 	log.Infof("%s=%s\n", dataDirEnvar, e.dataDir)
 	log.Infof("%s=%s\n", tmpDirEnvar, e.tmpDir)
-	log.Infof("%s=%s\n", checksumEnvar, e.checksum)
+	log.Infof("%s=%s\n", checksumEnvar, strings.Join(e.checksums, ","))
 	log.Infof("%s=%d\n", portEnvar, e.port)
 	log.Infof("%s=%s\n", logLevelEnvar, e.logLevel)
 	log.Infof("%s=%s\n", propEnvar, e.prop)
+	log.Infof("%s=%s\n", backendEnvar, e.backend)
+	log.Infof("%s=%d\n", maxUploadEnvar, e.maxUpload)
+	log.Infof("%s=%s\n", uploadAgeEnvar, e.uploadAge)
+	log.Infof("%s=%d\n", quotaEnvar, e.quota)
+	log.Infof("%s=%s\n", quotaFileEnvar, e.quotaFile)
+	log.Infof("%s=%d\n", versionsEnvar, e.versions)
+	log.Infof("%s=%s\n", versionsAgeEnvar, e.versionsAge)
+	log.Infof("%s=%t\n", trashEnvar, e.trash)
+	log.Infof("%s=%s\n", trashAgeEnvar, e.trashAge)
+	log.Infof("%s=%t\n", dedupEnvar, e.dedup)
+	log.Infof("%s=%s\n", keyFileEnvar, e.keyFile)
+	log.Infof("%s=%t\n", compressEnvar, e.compress)
+	log.Infof("%s=%s\n", verifyEnvar, e.verify)
+	log.Infof("%s=%s\n", scrubIntervalEnvar, e.scrubInterval)
+	log.Infof("%s=%d\n", scrubRateEnvar, e.scrubRate)
+	log.Infof("%s=%s\n", adminsEnvar, strings.Join(e.admins, ","))
+	log.Infof("%s=%s\n", shareEnvar, e.share)
+	log.Infof("%s=%s\n", shareCacheEnvar, e.shareCache)
+	log.Infof("%s=%s\n", shareFileEnvar, e.shareFile)
+	log.Infof("%s=%s\n", presignKeyEnvar, "******")
+	log.Infof("%s=%s\n", presignMaxAgeEnvar, e.presignMaxAge)
+	log.Infof("%s=%t\n", linksEnvar, e.links)
+	log.Infof("%s=%s\n", jwtAlgsEnvar, strings.Join(e.jwtAlgs, ","))
+	log.Infof("%s=%s\n", jwksFileEnvar, e.jwksFile)
+	log.Infof("%s=%s\n", jwtAudienceEnvar, e.jwtAudience)
+	log.Infof("%s=%s\n", jwtIssuerEnvar, e.jwtIssuer)
+	log.Infof("%s=%s\n", jwtLeewayEnvar, e.jwtLeeway)
+	log.Infof("%s=%t\n", jwtRequireExpEnvar, e.jwtRequireExp)
+	log.Infof("%s=%s\n", svcTokenFileEnvar, e.svcTokenFile)
 	log.Infof("%s=%s\n", sharedSecretEnvar, "******")
 }
 
@@ -83,10 +351,50 @@ func main() {
 	p := &newServerParams{}
 	p.dataDir = env.dataDir
 	p.tmpDir = env.tmpDir
-	p.checksum = env.checksum
+	p.checksums = env.checksums
 	p.prop = env.prop
+	p.backend = env.backend
+	p.maxUpload = env.maxUpload
+	p.uploadAge = env.uploadAge
+	p.quota = env.quota
+	p.quotaFile = env.quotaFile
+	p.versions = env.versions
+	p.versionsAge = env.versionsAge
+	p.trash = env.trash
+	p.trashAge = env.trashAge
+	p.dedup = env.dedup
+	p.keyFile = env.keyFile
+	p.compress = env.compress
+	p.verify = env.verify
+	p.scrubInterval = env.scrubInterval
+	p.scrubRate = env.scrubRate
+	p.admins = env.admins
+	p.share = env.share
+	p.shareCache = env.shareCache
+	p.presignKey = env.presignKey
+	p.presignMaxAge = env.presignMaxAge
+	p.links = env.links
+	p.jwtAlgs = env.jwtAlgs
+	p.jwksFile = env.jwksFile
+	p.jwtAudience = env.jwtAudience
+	p.jwtIssuer = env.jwtIssuer
+	p.jwtLeeway = env.jwtLeeway
+	p.jwtRequireExp = env.jwtRequireExp
+	p.svcTokenFile = env.svcTokenFile
 	p.sharedSecret = env.sharedSecret
 
+	// share-standin serves the grants of the share file on the
+	// address of the share service.
+	if len(os.Args) > 1 && os.Args[1] == "share-standin" {
+		if env.share == "" || env.shareFile == "" {
+			log.Errorf("%s and %s must be set to run the share stand-in",
+				shareEnvar, shareFileEnvar)
+			os.Exit(1)
+		}
+		log.Error(serveShareStandIn(env.share, env.shareFile, env.sharedSecret))
+		os.Exit(1)
+	}
+
 	// Create data and tmp dirs
 	if err := os.MkdirAll(p.dataDir, 0644); err != nil {
 		log.Error(err)
@@ -97,6 +405,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	// rotate-master-key adds a new master key to the keyfile
+	// and wraps the data keys with it.
+	if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+		if p.keyFile == "" {
+			log.Errorf("%s must be set to rotate the master key", keyFileEnvar)
+			os.Exit(1)
+		}
+		if err := rotateMasterKey(p); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	srv, err := newServer(p)
 	if err != nil {
 		log.Error(err)
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memoryStorage keeps the data in memory. It is meant for tests.
+// Like in the local filesystem, files and directories can only be
+// created inside directories that exist.
+type memoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+	dirs  map[string]time.Time
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+	attrs   map[string]string
+}
+
+func newMemoryStorage() *memoryStorage {
+	m := &memoryStorage{}
+	m.files = map[string]*memoryFile{}
+	m.dirs = map[string]time.Time{}
+	return m
+}
+
+func (m *memoryStorage) Open(p string) (storageFile, error) {
+
+	p = path.Clean(p)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info, err := m.stat(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	var data []byte
+	if f, ok := m.files[p]; ok {
+		data = f.data
+	}
+
+	return &memoryReader{bytes.NewReader(data), info}, nil
+}
+
+func (m *memoryStorage) Stat(p string) (os.FileInfo, error) {
+
+	p = path.Clean(p)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info, err := m.stat(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+
+	return info, nil
+}
+
+func (m *memoryStorage) ReadDir(p string) ([]os.FileInfo, error) {
+
+	p = path.Clean(p)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info, err := m.stat(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	names := map[string]bool{}
+	add := func(k string) {
+		if strings.HasPrefix(k, prefix) {
+			names[strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]] = true
+		}
+	}
+	for k := range m.files {
+		add(k)
+	}
+	for k := range m.dirs {
+		add(k)
+	}
+
+	infos := []os.FileInfo{}
+	for name := range names {
+		info, err := m.stat(prefix + name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(byName(infos))
+
+	return infos, nil
+}
+
+func (m *memoryStorage) Commit(tmpFn, p string) error {
+
+	p = path.Clean(p)
+
+	data, err := ioutil.ReadFile(tmpFn)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if err := m.checkParent(p); err != nil {
+		m.mu.Unlock()
+		return &os.PathError{Op: "commit", Path: p, Err: err}
+	}
+	if m.isDir(p) {
+		m.mu.Unlock()
+		return &os.PathError{Op: "commit", Path: p, Err: syscall.EISDIR}
+	}
+	m.files[p] = &memoryFile{data: data, modTime: time.Now()}
+	m.mu.Unlock()
+
+	return os.Remove(tmpFn)
+}
+
+func (m *memoryStorage) Mkdir(p string) error {
+
+	p = path.Clean(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.stat(p); err == nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+
+	if err := m.checkParent(p); err != nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+
+	m.dirs[p] = time.Now()
+	return nil
+}
+
+func (m *memoryStorage) Remove(p string) error {
+
+	p = path.Clean(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.hasChildren(p) {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+
+	if _, err := m.stat(p); err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+
+	delete(m.files, p)
+	delete(m.dirs, p)
+	return nil
+}
+
+func (m *memoryStorage) RemoveAll(p string) error {
+
+	p = path.Clean(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k := range m.files {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(m.files, k)
+		}
+	}
+	for k := range m.dirs {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(m.dirs, k)
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStorage) Rename(src, dst string) error {
+
+	src = path.Clean(src)
+	dst = path.Clean(dst)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.stat(src); err != nil {
+		return &os.PathError{Op: "rename", Path: src, Err: err}
+	}
+
+	if err := m.checkParent(dst); err != nil {
+		return &os.PathError{Op: "rename", Path: dst, Err: err}
+	}
+
+	if f, ok := m.files[src]; ok {
+		delete(m.files, src)
+		m.files[dst] = f
+		return nil
+	}
+
+	for k, f := range m.files {
+		if strings.HasPrefix(k, src+"/") {
+			delete(m.files, k)
+			m.files[dst+strings.TrimPrefix(k, src)] = f
+		}
+	}
+	for k, t := range m.dirs {
+		if k == src || strings.HasPrefix(k, src+"/") {
+			delete(m.dirs, k)
+			m.dirs[dst+strings.TrimPrefix(k, src)] = t
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStorage) GetAttrs(p string) (map[string]string, error) {
+
+	p = path.Clean(p)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, err := m.getFile(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "getattrs", Path: p, Err: err}
+	}
+
+	attrs := map[string]string{}
+	for name, value := range f.attrs {
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+func (m *memoryStorage) SetAttrs(p string, attrs map[string]string) error {
+
+	p = path.Clean(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := m.getFile(p)
+	if err != nil {
+		return &os.PathError{Op: "setattrs", Path: p, Err: err}
+	}
+
+	if f.attrs == nil {
+		f.attrs = map[string]string{}
+	}
+	for name, value := range attrs {
+		f.attrs[name] = value
+	}
+
+	return nil
+}
+
+// getFile returns the file p. Directories have no attributes.
+func (m *memoryStorage) getFile(p string) (*memoryFile, error) {
+
+	if f, ok := m.files[p]; ok {
+		return f, nil
+	}
+
+	if m.isDir(p) {
+		return nil, syscall.EISDIR
+	}
+
+	return nil, os.ErrNotExist
+}
+
+func (m *memoryStorage) stat(p string) (os.FileInfo, error) {
+
+	if f, ok := m.files[p]; ok {
+		return &memoryFileInfo{path.Base(p), int64(len(f.data)), f.modTime, false}, nil
+	}
+
+	if m.isDir(p) {
+		return &memoryFileInfo{path.Base(p), 0, m.dirs[p], true}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// checkParent returns an error if the parent of p is not a directory.
+func (m *memoryStorage) checkParent(p string) error {
+
+	dir := path.Dir(p)
+
+	if _, ok := m.files[dir]; ok {
+		return syscall.ENOTDIR
+	}
+
+	if !m.isDir(dir) {
+		return os.ErrNotExist
+	}
+
+	return nil
+}
+
+func (m *memoryStorage) isDir(p string) bool {
+	_, ok := m.dirs[p]
+	return ok || p == "/"
+}
+
+func (m *memoryStorage) hasChildren(p string) bool {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for k := range m.files {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	for k := range m.dirs {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryReader struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (r *memoryReader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i *memoryFileInfo) Name() string       { return i.name }
+func (i *memoryFileInfo) Size() int64        { return i.size }
+func (i *memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memoryFileInfo) IsDir() bool        { return i.isDir }
+func (i *memoryFileInfo) Sys() interface{}   { return nil }
+
+func (i *memoryFileInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir | dirPerm
+	}
+	return 0644
+}
+
+type byName []os.FileInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
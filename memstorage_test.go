@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// newTestTmpFile returns a tmp file with data.
+func newTestTmpFile(t *testing.T, data string) string {
+	fd, err := ioutil.TempFile("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	return fd.Name()
+}
+
+// commitTestFile commits data into p of st.
+func commitTestFile(t *testing.T, st storage, p string, data []byte) {
+	tmpFn := newTestTmpFile(t, string(data))
+	if err := st.Commit(tmpFn, p); err != nil {
+		os.Remove(tmpFn)
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the contents of p of st.
+func readTestFile(st storage, p string) ([]byte, error) {
+	fd, err := st.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
+
+func TestMemoryStorageParentMustExist(t *testing.T) {
+
+	m := newMemoryStorage()
+
+	if err := m.Mkdir("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("Mkdir without parent: got %v, want not exist", err)
+	}
+
+	tmpFn := newTestTmpFile(t, "data")
+	defer os.Remove(tmpFn)
+
+	if err := m.Commit(tmpFn, "/a/f"); !os.IsNotExist(err) {
+		t.Errorf("Commit without parent: got %v, want not exist", err)
+	}
+
+	if err := m.Mkdir("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Commit(tmpFn, "/a/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpFn = newTestTmpFile(t, "data")
+	defer os.Remove(tmpFn)
+
+	err := m.Commit(tmpFn, "/a/f/g")
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOTDIR {
+		t.Errorf("Commit into a file: got %v, want not a directory", err)
+	}
+	if err := m.Mkdir("/a/f/g"); err == nil {
+		t.Error("Mkdir into a file succeeded")
+	}
+	if err := m.Rename("/a/f", "/b/f"); !os.IsNotExist(err) {
+		t.Errorf("Rename without parent: got %v, want not exist", err)
+	}
+
+	if err := m.Mkdir("/a"); !os.IsExist(err) {
+		t.Errorf("Mkdir of an existing directory: got %v, want exist", err)
+	}
+}
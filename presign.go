@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pre-signed URLs give access to a file in a home without a token.
+// They are signed with HMAC-SHA256 over the method, the path, the idp of
+// the user, the expiry time, the maximum upload size and the checksum of
+// the contents, using the pre-sign key or the shared secret if the key is
+// not set.
+//
+// GET URLs download the file, and also allow HEAD requests. If they carry
+// a checksum the file is only served while its saved checksum matches.
+// PUT URLs upload the file. The upload must match the checksum, if any,
+// and it cannot be larger than the maximum size, if any.
+//
+// Requests with pre-signed URLs are served on behalf of the owner of
+// the home, so only paths inside the home of the user can be signed.
+//
+// POST /presign?path=<path>&method=<GET|PUT>&expires_in=<seconds>
+// &max_size=<bytes>&checksum=<type>:<sum> returns the pre-signed URL.
+
+const (
+	presignEndPoint = "/presign"
+
+	presignIdpParam       = "idp"
+	presignExpiresParam   = "expires"
+	presignMaxSizeParam   = "max_size"
+	presignChecksumParam  = "checksum"
+	presignSignatureParam = "signature"
+
+	// presignDefaultLifetime is the lifetime of the URLs minted without
+	// expires_in. It is capped to the maximum lifetime.
+	presignDefaultLifetime = time.Hour
+)
+
+// presignAllowedParams are the query params accepted along with a
+// pre-signed URL. Others could change what the request does, like
+// version, so they are rejected.
+var presignAllowedParams = map[string]bool{
+	presignIdpParam:       true,
+	presignExpiresParam:   true,
+	presignMaxSizeParam:   true,
+	presignChecksumParam:  true,
+	presignSignatureParam: true,
+	"create_parents":      true,
+}
+
+type presignedURL struct {
+	method    string
+	path      string
+	idp       string
+	expires   int64
+	maxSize   int64
+	checksum  string
+	signature string
+}
+
+type presignResponse struct {
+	URL     string `json:"url"`
+	Method  string `json:"method"`
+	Expires int64  `json:"expires"`
+}
+
+// presignedKey is the context key for the pre-signed URL of the request.
+const presignedKey key = 2
+
+// newPresignedContext returns a new Context carrying a pre-signed URL.
+func newPresignedContext(ctx context.Context, pu *presignedURL) context.Context {
+	return context.WithValue(ctx, presignedKey, pu)
+}
+
+// fromPresignedContext returns the pre-signed URL of the request. It
+// reports false if the request was authenticated with a token.
+func fromPresignedContext(ctx context.Context) (*presignedURL, bool) {
+	pu, ok := ctx.Value(presignedKey).(*presignedURL)
+	return pu, ok
+}
+
+// sign returns the signature of pu made with secret.
+func (pu *presignedURL) sign(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%d\n%s", pu.method, pu.path, pu.idp,
+		pu.expires, pu.maxSize, pu.checksum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// String returns pu as a relative URL.
+func (pu *presignedURL) String() string {
+
+	q := url.Values{}
+	q.Set(presignIdpParam, pu.idp)
+	q.Set(presignExpiresParam, strconv.FormatInt(pu.expires, 10))
+	if pu.maxSize > 0 {
+		q.Set(presignMaxSizeParam, strconv.FormatInt(pu.maxSize, 10))
+	}
+	if pu.checksum != "" {
+		q.Set(presignChecksumParam, pu.checksum)
+	}
+	q.Set(presignSignatureParam, pu.signature)
+
+	u := &url.URL{Path: pu.path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+func (s *server) getPresignKey() string {
+	if s.p.presignKey != "" {
+		return s.p.presignKey
+	}
+	return s.p.sharedSecret
+}
+
+// isPresignedReq reports if r is authenticated with a pre-signed URL.
+func (s *server) isPresignedReq(r *http.Request) bool {
+	return s.p.presignMaxAge > 0 && r.URL.Query().Get(presignSignatureParam) != ""
+}
+
+// presign handles the requests to the presign endpoint.
+func (s *server) presign(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	if strings.ToUpper(r.Method) != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.WithField("op", "presign").Info()
+
+	q := r.URL.Query()
+
+	pu := &presignedURL{}
+	pu.path = path.Clean("/" + q.Get("path"))
+	pu.idp = idt.Idp
+
+	if !isUnderHome(pu.path, idt) || pu.path == getHome(idt) {
+		log.Warnf("%s cannot sign %s", *idt, pu.path)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	pu.method = strings.ToUpper(q.Get("method"))
+	if pu.method == "" {
+		pu.method = "GET"
+	}
+	if pu.method != "GET" && pu.method != "PUT" {
+		log.Errorf("cannot sign method %q", pu.method)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	lifetime := presignDefaultLifetime
+	if v := q.Get("expires_in"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || secs <= 0 {
+			log.Errorf("invalid expires_in %q", v)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		lifetime = time.Duration(secs) * time.Second
+	}
+	if lifetime > s.p.presignMaxAge {
+		lifetime = s.p.presignMaxAge
+	}
+	pu.expires = time.Now().Add(lifetime).Unix()
+
+	if v := q.Get(presignMaxSizeParam); v != "" {
+		maxSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxSize <= 0 || pu.method != "PUT" {
+			log.Errorf("invalid max_size %q for %s", v, pu.method)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		pu.maxSize = maxSize
+	}
+
+	if v := q.Get(presignChecksumParam); v != "" {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			log.Errorf("invalid checksum %q", v)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		t := strings.ToLower(parts[0])
+		if _, ok := checksumTypes[t]; !ok {
+			err := &unsupportedChecksumError{t}
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pu.checksum = t + ":" + parts[1]
+	}
+
+	// URLs cannot give more access than the token minting them.
+	if err := checkScope(ctx, pu.method, pu.path); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	pu.signature = pu.sign(s.getPresignKey())
+
+	log.Infof("%s signed %s %s until %s", *idt, pu.method, pu.path,
+		time.Unix(pu.expires, 0).UTC().Format(time.RFC3339))
+
+	res := &presignResponse{}
+	res.URL = pu.String()
+	res.Method = pu.method
+	res.Expires = pu.expires
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// getPresignedFromReq returns the pre-signed URL of r. The method of
+// HEAD requests is GET.
+func getPresignedFromReq(r *http.Request) (*presignedURL, error) {
+
+	q := r.URL.Query()
+	for name := range q {
+		if !presignAllowedParams[name] {
+			return nil, fmt.Errorf("query param %q not allowed in pre-signed URLs", name)
+		}
+	}
+
+	pu := &presignedURL{}
+	pu.method = strings.ToUpper(r.Method)
+	if pu.method == "HEAD" {
+		pu.method = "GET"
+	}
+	pu.path = getPathFromReq(r)
+	pu.idp = q.Get(presignIdpParam)
+	pu.checksum = q.Get(presignChecksumParam)
+	pu.signature = q.Get(presignSignatureParam)
+
+	expires, err := strconv.ParseInt(q.Get(presignExpiresParam), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry: %s", err)
+	}
+	pu.expires = expires
+
+	if v := q.Get(presignMaxSizeParam); v != "" {
+		maxSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max size: %s", err)
+		}
+		pu.maxSize = maxSize
+	}
+
+	return pu, nil
+}
+
+// presignedHandler authenticates the request with its pre-signed URL
+// and saves the owner of the path as the identity into ctx.
+func (s *server) presignedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+
+	log := MustFromLogContext(ctx)
+
+	pu, err := getPresignedFromReq(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	expected := pu.sign(s.getPresignKey())
+	if !hmac.Equal([]byte(pu.signature), []byte(expected)) {
+		log.Warnf("invalid signature for %s %s", pu.method, pu.path)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if time.Now().Unix() > pu.expires {
+		log.Warnf("pre-signed URL for %s %s expired at %s", pu.method, pu.path,
+			time.Unix(pu.expires, 0).UTC().Format(time.RFC3339))
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	owner := getOwnerIdentity(pu.path, pu.idp)
+	if owner == nil {
+		log.Warnf("%s is not inside a home", pu.path)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if pu.method == "GET" && pu.checksum != "" && !s.matchesChecksum(ctx, w, pu) {
+		return
+	}
+
+	log.Infof("pre-signed %s of %s on behalf of %s", pu.method, pu.path, *owner)
+
+	// There is no token, so shared paths cannot be resolved.
+	ctx = newPresignedContext(ctx, pu)
+	ctx = authlib.NewContext(ctx, owner)
+	ctx = authlib.NewTokenContext(ctx, "")
+	next(ctx, w, r)
+}
+
+// matchesChecksum reports if the saved checksum of the file of pu matches
+// the signed one, otherwise the error is already written into w.
+// Missing files are left to the handler.
+func (s *server) matchesChecksum(ctx context.Context, w http.ResponseWriter, pu *presignedURL) bool {
+
+	log := MustFromLogContext(ctx)
+
+	attrs, err := s.getAttrs(pu.path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+
+	parts := strings.SplitN(pu.checksum, ":", 2)
+	if c := findChecksum(attrs.checksums, parts[0]); c == nil || len(parts) != 2 || c.Sum != parts[1] {
+		log.Errorf("%s does not match the signed checksum %s", pu.path, pu.checksum)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// getMaxUpload returns the maximum size of the upload of the request
+// found in ctx or 0 if there is no limit.
+func (s *server) getMaxUpload(ctx context.Context) int64 {
+	max := s.p.maxUpload
+	if pu, ok := fromPresignedContext(ctx); ok && pu.maxSize > 0 {
+		if max == 0 || pu.maxSize < max {
+			max = pu.maxSize
+		}
+	}
+	return max
+}
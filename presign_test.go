@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newPresignTestEnv(t *testing.T) *testEnv {
+	return newTestEnv(t, func(p *newServerParams) {
+		p.presignMaxAge = time.Hour
+	})
+}
+
+// presign returns the pre-signed URL of method on p with the extra params.
+func (te *testEnv) presign(token, method, p string, params url.Values) string {
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("path", p)
+	params.Set("method", method)
+
+	w := te.expect(http.StatusOK, "POST", presignEndPoint+"?"+params.Encode(), token, "", nil)
+
+	res := &presignResponse{}
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil {
+		te.t.Fatal(err)
+	}
+	return res.URL
+}
+
+func TestPresignDownload(t *testing.T) {
+
+	te := newPresignTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+	te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+
+	u := te.presign(tk, "GET", p, nil)
+
+	w := te.expect(http.StatusOK, "GET", u, "", "", nil)
+	if w.Body.String() != "hello" {
+		t.Errorf("got %q, want %q", w.Body.String(), "hello")
+	}
+	te.expect(http.StatusOK, "HEAD", u, "", "", nil)
+
+	// The URL only gives access to the signed method and path.
+	te.expect(http.StatusForbidden, "PUT", u, "", "bye", nil)
+	parsed, _ := url.Parse(u)
+	te.expect(http.StatusForbidden, "GET", testHome+"/b.txt?"+parsed.RawQuery, "", "", nil)
+
+	// Every signed field is checked.
+	for _, name := range []string{presignIdpParam, presignExpiresParam, presignSignatureParam, presignMaxSizeParam} {
+		q := parsed.Query()
+		q.Set(name, "99999999999")
+		te.expect(http.StatusForbidden, "GET", p+"?"+q.Encode(), "", "", nil)
+	}
+
+	// Other params are rejected.
+	q := parsed.Query()
+	q.Set("version", "1")
+	te.expect(http.StatusForbidden, "GET", p+"?"+q.Encode(), "", "", nil)
+
+	// Expired URLs are rejected.
+	pu := &presignedURL{method: "GET", path: p, idp: "local", expires: time.Now().Add(-time.Minute).Unix()}
+	pu.signature = pu.sign(testSecret)
+	te.expect(http.StatusForbidden, "GET", pu.String(), "", "", nil)
+
+	// Only paths inside the home can be signed.
+	q = url.Values{"path": {"/local/users/b/bob/a.txt"}}
+	te.expect(http.StatusForbidden, "POST", presignEndPoint+"?"+q.Encode(), tk, "", nil)
+}
+
+func TestPresignUpload(t *testing.T) {
+
+	te := newPresignTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	u := te.presign(tk, "PUT", p, url.Values{"max_size": {"5"}})
+	te.expect(http.StatusRequestEntityTooLarge, "PUT", u, "", "too long", nil)
+	te.expect(http.StatusCreated, "PUT", u, "", "hello", nil)
+
+	w := te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if w.Body.String() != "hello" {
+		t.Errorf("got %q, want %q", w.Body.String(), "hello")
+	}
+
+	u = te.presign(tk, "PUT", p, url.Values{"checksum": {"md5:5d41402abc4b2a76b9719d911017c592"}})
+	te.expect(http.StatusPreconditionFailed, "PUT", u, "", "other", nil)
+	te.expect(http.StatusCreated, "PUT", u, "", "hello", nil)
+}
@@ -0,0 +1,113 @@
+// Code generated by protoc-gen-go.
+// source: share.proto
+// DO NOT EDIT!
+
+/*
+Package share is a generated protocol buffer package.
+
+It is generated from these files:
+	share.proto
+
+It has these top-level messages:
+	LookupReq
+	Grant
+*/
+package share
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// LookupReq asks for the access granted to the identity of the access
+// token on the path.
+type LookupReq struct {
+	AccessToken string `protobuf:"bytes,1,opt,name=access_token" json:"access_token,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+}
+
+func (m *LookupReq) Reset()         { *m = LookupReq{} }
+func (m *LookupReq) String() string { return proto.CompactTextString(m) }
+func (*LookupReq) ProtoMessage()    {}
+
+// Grant is the access granted on the path. owner_idp is the identity
+// provider of the owner of the home the path belongs to.
+type Grant struct {
+	Read     bool   `protobuf:"varint,1,opt,name=read" json:"read,omitempty"`
+	Write    bool   `protobuf:"varint,2,opt,name=write" json:"write,omitempty"`
+	OwnerIdp string `protobuf:"bytes,3,opt,name=owner_idp" json:"owner_idp,omitempty"`
+}
+
+func (m *Grant) Reset()         { *m = Grant{} }
+func (m *Grant) String() string { return proto.CompactTextString(m) }
+func (*Grant) ProtoMessage()    {}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for Share service
+
+type ShareClient interface {
+	Lookup(ctx context.Context, in *LookupReq, opts ...grpc.CallOption) (*Grant, error)
+}
+
+type shareClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewShareClient(cc *grpc.ClientConn) ShareClient {
+	return &shareClient{cc}
+}
+
+func (c *shareClient) Lookup(ctx context.Context, in *LookupReq, opts ...grpc.CallOption) (*Grant, error) {
+	out := new(Grant)
+	err := grpc.Invoke(ctx, "/share.Share/Lookup", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Share service
+
+type ShareServer interface {
+	Lookup(context.Context, *LookupReq) (*Grant, error)
+}
+
+func RegisterShareServer(s *grpc.Server, srv ShareServer) {
+	s.RegisterService(&_Share_serviceDesc, srv)
+}
+
+func _Share_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(LookupReq)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(ShareServer).Lookup(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var _Share_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "share.Share",
+	HandlerType: (*ShareServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _Share_Lookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
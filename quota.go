@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	authlib "github.com/clawio/service-auth/lib"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// errQuotaExceeded is returned when an operation would make the
+// user exceed the quota.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaManager enforces the maximum number of bytes each user can store
+// under the home directory.
+//
+// The quota of a user is looked up in the quota file by <idp>/<pid>
+// and then by <pid>. If not found the default quota is used.
+// A quota of 0 means unlimited.
+//
+// The usage of a home directory is computed walking the tree the first
+// time it is needed and then it is updated with every operation.
+type quotaManager struct {
+	defaultQuota int64
+	quotas       map[string]int64
+	storage      storage
+
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// newQuotaManager returns a quota manager. quotaFile is a JSON object
+// mapping users to quotas in bytes. It is ignored if empty.
+func newQuotaManager(defaultQuota int64, quotaFile string, st storage) (*quotaManager, error) {
+
+	q := &quotaManager{}
+	q.defaultQuota = defaultQuota
+	q.quotas = map[string]int64{}
+	q.storage = st
+	q.usage = map[string]int64{}
+
+	if quotaFile == "" {
+		return q, nil
+	}
+
+	data, err := ioutil.ReadFile(quotaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &q.quotas); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// getQuota returns the quota of idt in bytes.
+func (q *quotaManager) getQuota(idt *authlib.Identity) int64 {
+
+	if v, ok := q.quotas[idt.Idp+"/"+idt.Pid]; ok {
+		return v
+	}
+
+	if v, ok := q.quotas[idt.Pid]; ok {
+		return v
+	}
+
+	return q.defaultQuota
+}
+
+// getAvailable returns the number of bytes idt can still store.
+// It returns -1 if the quota is unlimited.
+func (q *quotaManager) getAvailable(idt *authlib.Identity) (int64, error) {
+
+	quota := q.getQuota(idt)
+	if quota == 0 {
+		return -1, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, err := q.getUsage(getHome(idt))
+	if err != nil {
+		return 0, err
+	}
+
+	if usage > quota {
+		return 0, nil
+	}
+
+	return quota - usage, nil
+}
+
+// reserve adds delta bytes to the usage of idt.
+// It returns errQuotaExceeded if the usage would go over the quota.
+func (q *quotaManager) reserve(idt *authlib.Identity, delta int64) error {
+
+	quota := q.getQuota(idt)
+	if quota == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	home := getHome(idt)
+
+	usage, err := q.getUsage(home)
+	if err != nil {
+		return err
+	}
+
+	if delta > 0 && usage+delta > quota {
+		return errQuotaExceeded
+	}
+
+	q.usage[home] = usage + delta
+	return nil
+}
+
+// release removes delta bytes from the usage of idt.
+func (q *quotaManager) release(idt *authlib.Identity, delta int64) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	home := getHome(idt)
+
+	// The usage will be computed when it is needed.
+	if _, ok := q.usage[home]; !ok {
+		return
+	}
+
+	q.usage[home] -= delta
+}
+
+// getUsage must be called with mu held.
+func (q *quotaManager) getUsage(home string) (int64, error) {
+
+	if usage, ok := q.usage[home]; ok {
+		return usage, nil
+	}
+
+	usage, err := getTreeSize(q.storage, home)
+	if err != nil {
+		return 0, err
+	}
+
+	q.usage[home] = usage
+	return usage, nil
+}
+
+// getTreeSize returns the number of bytes stored under p.
+// A home directory that does not exist yet uses 0 bytes.
+func getTreeSize(st storage, p string) (int64, error) {
+
+	info, err := st.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+
+	infos, err := st.ReadDir(p)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, info := range infos {
+		s, err := getTreeSize(st, path.Join(p, info.Name()))
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+
+	return size, nil
+}
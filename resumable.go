@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"github.com/clawio/service-localfs-data/lib"
+	"github.com/nu7hatch/gouuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads follow the tus protocol (http://tus.io):
+//
+// 1. POST <path> with the Upload-Length header creates an upload session.
+//    The session ID is returned in the Upload-ID header and in the Location
+//    header as the upload_id query param.
+// 2. PATCH <path>?upload_id=<id> with the Upload-Offset header and
+//    Content-Type: application/offset+octet-stream appends the body to the
+//    upload at the given offset.
+// 3. HEAD <path>?upload_id=<id> returns the current offset in the
+//    Upload-Offset header so the client knows where to resume from.
+// 4. When the offset reaches the length the upload is finalized: the
+//    checksum is verified and the file is committed.
+//
+// The state of the sessions lives in the uploads directory inside the
+// tmp dir, so uploads can be resumed after the service is restarted.
+//
+// The If-Match and If-None-Match headers of the POST are evaluated when
+// the session is created and again when the file is committed.
+//
+// Sessions expire after the upload age, returned in the Upload-Expires
+// header, and are removed in the background. The length of the open
+// sessions of a user counts toward the quota until they finish or expire.
+// The reserved bytes of every home are kept in memory and computed from
+// the sessions in the uploads directory when the server starts.
+
+const (
+	uploadsDir        = "uploads"
+	uploadContentType = "application/offset+octet-stream"
+	tusVersion        = "1.0.0"
+
+	defaultUploadAge     = 24 * time.Hour
+	uploadExpiryInterval = time.Hour
+)
+
+type uploadSession struct {
+	ID           string      `json:"id"`
+	Path         string      `json:"path"`
+	Length       int64       `json:"length"`
+	ChecksumType string      `json:"checksum_type"`
+	ChecksumSum  string      `json:"checksum_sum"`
+	Digests      []*checksum `json:"digests"`
+	Created      time.Time   `json:"created"`
+	Home         string      `json:"home"`
+	IfMatch      string      `json:"if_match,omitempty"`
+	IfNoneMatch  string      `json:"if_none_match,omitempty"`
+}
+
+func (s *server) createUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	p := lib.MustFromContext(ctx)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		log.Errorf("invalid Upload-Length %q", r.Header.Get("Upload-Length"))
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	maxUpload := s.getMaxUpload(ctx)
+
+	if maxUpload > 0 && length > maxUpload {
+		log.Errorf("upload of %d bytes exceeds the maximum of %d bytes",
+			length, maxUpload)
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	idt := authlib.MustFromContext(ctx)
+
+	available, err := s.getAvailable(idt)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	info, err := s.storage.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		info = nil
+	}
+
+	if !checkPutPreconditions(r, info) {
+		log.Errorf("preconditions failed for %s", p)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+
+	if available >= 0 {
+		// The bytes of the file being replaced are freed.
+		if info != nil && !info.IsDir() {
+			available += info.Size()
+		}
+
+		if length > available {
+			log.Errorf("upload of %d bytes exceeds the %d bytes available",
+				length, available)
+			http.Error(w, "", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	_uuid, err := uuid.NewV4()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	chks, err := s.getChecksumsFromReq(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The checksums are verified when the upload is finished,
+	// so their types must be supported.
+	if _, err := s.newHashers(chks...); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess := &uploadSession{}
+	sess.ID = _uuid.String()
+	sess.Path = p
+	sess.Length = length
+	if len(chks) > 0 {
+		sess.ChecksumType = chks[0].Type
+		sess.ChecksumSum = chks[0].Sum
+		sess.Digests = chks[1:]
+	}
+	sess.Created = time.Now()
+	sess.Home = getHome(idt)
+	sess.IfMatch = r.Header.Get("If-Match")
+	sess.IfNoneMatch = r.Header.Get("If-None-Match")
+
+	if err := os.MkdirAll(s.getUploadsDir(), dirPerm); err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	fd, err := os.Create(s.getUploadDataPath(sess.ID))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	fd.Close()
+
+	if err := s.saveUploadSession(sess); err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	s.reserveUpload(sess)
+
+	log.Infof("created upload session %s for %s with length %d", sess.ID, p, length)
+
+	w.Header().Set("Upload-ID", sess.ID)
+	w.Header().Set("Upload-Offset", "0")
+	s.setUploadExpires(w, sess)
+	w.Header().Set("Location", r.URL.Path+"?upload_id="+sess.ID)
+
+	if length == 0 {
+		s.finishUpload(ctx, w, sess)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) headUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+
+	sess, err := s.getUploadSession(ctx, r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	offset, err := s.getUploadOffset(sess)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(sess.Length, 10))
+	s.setUploadExpires(w, sess)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) patchUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Content-Type") != uploadContentType {
+		log.Errorf("invalid content type %q", r.Header.Get("Content-Type"))
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	sess, err := s.getUploadSession(ctx, r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	// Only one PATCH can be applied at the same time to a session.
+	if !s.lockUpload(sess.ID) {
+		log.Errorf("upload session %s is busy", sess.ID)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+	defer s.unlockUpload(sess.ID)
+
+	offset, err := s.getUploadOffset(sess)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		log.Errorf("invalid Upload-Offset %q. current offset is %d",
+			r.Header.Get("Upload-Offset"), offset)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	fd, err := os.OpenFile(s.getUploadDataPath(sess.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// Bytes written before a network failure are kept so the
+	// client can resume from the new offset.
+	n, err := io.Copy(fd, io.LimitReader(r.Body, sess.Length-offset))
+	fd.Close()
+	offset += n
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("appended %d bytes to upload session %s. offset is %d", n, sess.ID, offset)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	s.setUploadExpires(w, sess)
+
+	if offset == sess.Length {
+		s.finishUpload(ctx, w, sess)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload verifies the checksum of a completed upload and commits it.
+func (s *server) finishUpload(ctx context.Context, w http.ResponseWriter, sess *uploadSession) {
+
+	log := MustFromLogContext(ctx)
+
+	fn := s.getUploadDataPath(sess.ID)
+	chk := &checksum{sess.ChecksumType, sess.ChecksumSum}
+	chks := append([]*checksum{chk}, sess.Digests...)
+
+	hashers, err := s.newHashers(chks...)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if len(hashers.types) > 0 {
+		fd, err := os.Open(fn)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(hashers, fd)
+		fd.Close()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		if err := hashers.verify(chks...); err != nil {
+			// The data is corrupted so the session cannot be resumed.
+			log.Error(err)
+			s.removeUploadSession(sess)
+			http.Error(w, "", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	computed := hashers.getAll()
+
+	precond := func(info os.FileInfo) bool {
+		return checkPreconditions(sess.IfMatch, sess.IfNoneMatch, info)
+	}
+
+	err = s.commit(ctx, fn, sess.Path, chk, computed, precond)
+	if err == errPreconditionFailed {
+		// The file changed since the session was created.
+		log.Errorf("preconditions failed for %s", sess.Path)
+		s.removeUploadSession(sess)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+
+	if err == errQuotaExceeded {
+		// The session is kept so the upload can be finished
+		// once the user frees some space.
+		log.Error(err)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	s.removeUploadSession(sess)
+
+	log.Infof("finished upload session %s", sess.ID)
+
+	if info, err := s.storage.Stat(sess.Path); err == nil {
+		w.Header().Set("ETag", getETag(info))
+	}
+
+	setChecksumHeaders(w, computed)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUploadSession returns the session identified by the upload_id query
+// param or the Upload-ID header.
+// The session must belong to the path found in ctx.
+func (s *server) getUploadSession(ctx context.Context, r *http.Request) (*uploadSession, error) {
+
+	id := r.URL.Query().Get("upload_id")
+	if id == "" {
+		id = r.Header.Get("Upload-ID")
+	}
+
+	// The ID is used to build paths, so it must be a valid UUID.
+	if _, err := uuid.ParseHex(id); err != nil {
+		return nil, fmt.Errorf("invalid upload id %q", id)
+	}
+
+	data, err := ioutil.ReadFile(s.getUploadInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &uploadSession{}
+	if err := json.Unmarshal(data, sess); err != nil {
+		return nil, err
+	}
+
+	if sess.Path != lib.MustFromContext(ctx) {
+		return nil, fmt.Errorf("upload session %s does not belong to %s",
+			id, lib.MustFromContext(ctx))
+	}
+
+	if s.isUploadExpired(sess) {
+		return nil, fmt.Errorf("upload session %s expired", id)
+	}
+
+	return sess, nil
+}
+
+func (s *server) isUploadExpired(sess *uploadSession) bool {
+	return s.p.uploadAge > 0 && time.Since(sess.Created) > s.p.uploadAge
+}
+
+func (s *server) setUploadExpires(w http.ResponseWriter, sess *uploadSession) {
+	if s.p.uploadAge > 0 {
+		expires := sess.Created.Add(s.p.uploadAge).UTC()
+		w.Header().Set("Upload-Expires", expires.Format(http.TimeFormat))
+	}
+}
+
+// listUploadSessions returns the sessions saved in the uploads directory.
+// Sessions that cannot be read are skipped.
+func (s *server) listUploadSessions() ([]*uploadSession, error) {
+
+	infos, err := ioutil.ReadDir(s.getUploadsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*uploadSession{}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".info") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path.Join(s.getUploadsDir(), info.Name()))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		sess := &uploadSession{}
+		if err := json.Unmarshal(data, sess); err != nil {
+			log.Errorf("invalid upload session %s: %s", info.Name(), err)
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sessions, nil
+}
+
+// loadUploadReservations reserves the length of the sessions found in
+// the uploads directory that have not expired.
+func (s *server) loadUploadReservations() error {
+
+	sessions, err := s.listUploadSessions()
+	if err != nil {
+		return err
+	}
+
+	for _, sess := range sessions {
+		if !s.isUploadExpired(sess) {
+			s.reserveUpload(sess)
+		}
+	}
+
+	return nil
+}
+
+// reserveUpload adds the length of sess to the bytes reserved in its home.
+func (s *server) reserveUpload(sess *uploadSession) {
+
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	if _, ok := s.uploadsReserved[sess.ID]; ok {
+		return
+	}
+
+	s.uploadsReserved[sess.ID] = sess
+	s.homesReserved[sess.Home] += sess.Length
+}
+
+// releaseUpload frees the bytes reserved by sess.
+func (s *server) releaseUpload(sess *uploadSession) {
+
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	if _, ok := s.uploadsReserved[sess.ID]; !ok {
+		return
+	}
+
+	delete(s.uploadsReserved, sess.ID)
+	s.homesReserved[sess.Home] -= sess.Length
+	if s.homesReserved[sess.Home] <= 0 {
+		delete(s.homesReserved, sess.Home)
+	}
+}
+
+// getReservedUploads returns the number of bytes reserved by the open
+// sessions of the uploads to home.
+func (s *server) getReservedUploads(home string) int64 {
+
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	return s.homesReserved[home]
+}
+
+// getAvailable returns the number of bytes idt can still upload, which
+// are not reserved by open upload sessions. It returns -1 if the quota
+// is unlimited.
+func (s *server) getAvailable(idt *authlib.Identity) (int64, error) {
+
+	available, err := s.quota.getAvailable(idt)
+	if err != nil || available < 0 {
+		return available, err
+	}
+
+	reserved := s.getReservedUploads(getHome(idt))
+
+	if reserved > available {
+		return 0, nil
+	}
+
+	return available - reserved, nil
+}
+
+// expireUploads removes the expired upload sessions forever.
+func (s *server) expireUploads() {
+
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.expireUploadSessions()
+		<-ticker.C
+	}
+}
+
+func (s *server) expireUploadSessions() {
+
+	sessions, err := s.listUploadSessions()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, sess := range sessions {
+		if !s.isUploadExpired(sess) {
+			continue
+		}
+
+		// Sessions being written are removed in the next round.
+		if !s.lockUpload(sess.ID) {
+			continue
+		}
+		s.removeUploadSession(sess)
+		s.unlockUpload(sess.ID)
+
+		log.Infof("removed expired upload session %s of %s", sess.ID, sess.Path)
+	}
+}
+
+func (s *server) saveUploadSession(sess *uploadSession) error {
+
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.getUploadInfoPath(sess.ID), data, 0644)
+}
+
+// removeUploadSession removes sess and frees the bytes it reserves.
+func (s *server) removeUploadSession(sess *uploadSession) {
+	os.Remove(s.getUploadDataPath(sess.ID))
+	os.Remove(s.getUploadInfoPath(sess.ID))
+	s.releaseUpload(sess)
+}
+
+// getUploadOffset returns the number of bytes already received.
+func (s *server) getUploadOffset(sess *uploadSession) (int64, error) {
+
+	info, err := os.Stat(s.getUploadDataPath(sess.ID))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (s *server) lockUpload(id string) bool {
+
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	if s.uploadsBusy[id] {
+		return false
+	}
+
+	s.uploadsBusy[id] = true
+	return true
+}
+
+func (s *server) unlockUpload(id string) {
+
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+
+	delete(s.uploadsBusy, id)
+}
+
+func (s *server) getUploadsDir() string {
+	return path.Join(s.p.tmpDir, uploadsDir)
+}
+
+func (s *server) getUploadDataPath(id string) string {
+	return path.Join(s.getUploadsDir(), id)
+}
+
+func (s *server) getUploadInfoPath(id string) string {
+	return path.Join(s.getUploadsDir(), id+".info")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// createUpload creates an upload session of length bytes for p and
+// returns its URL.
+func (te *testEnv) createUpload(token, p string, length int, headers map[string]string) string {
+
+	h := map[string]string{"Upload-Length": strconv.Itoa(length)}
+	for name, value := range headers {
+		h[name] = value
+	}
+
+	w := te.expect(http.StatusCreated, "POST", p, token, "", h)
+	if w.Header().Get("Upload-ID") == "" {
+		te.t.Fatal("upload session without Upload-ID")
+	}
+	return w.Header().Get("Location")
+}
+
+// patchUpload appends data to the upload u at offset.
+func (te *testEnv) patchUpload(status int, token, u string, offset int, data string) {
+	te.expect(status, "PATCH", u, token, data, map[string]string{
+		"Content-Type":  uploadContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+}
+
+func TestResumableUpload(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	u := te.createUpload(tk, p, 10, nil)
+
+	te.patchUpload(http.StatusNoContent, tk, u, 0, "hello")
+	w := te.expect(http.StatusOK, "HEAD", u, tk, "", nil)
+	if w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("got offset %q, want 5", w.Header().Get("Upload-Offset"))
+	}
+
+	// The offset must be the current one.
+	te.patchUpload(http.StatusConflict, tk, u, 0, "hello")
+	te.expect(http.StatusUnsupportedMediaType, "PATCH", u, tk, "world",
+		map[string]string{"Upload-Offset": "5"})
+
+	// Sessions can only be used by their owner and for their path.
+	te.patchUpload(http.StatusForbidden, newTestToken("bob", nil), u, 5, "world")
+	te.expect(http.StatusNotFound, "HEAD", testHome+"/b.txt?"+u[len(p)+1:], tk, "", nil)
+
+	te.patchUpload(http.StatusNoContent, tk, u, 5, "world")
+
+	w = te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if w.Body.String() != "helloworld" {
+		t.Errorf("got %q, want %q", w.Body.String(), "helloworld")
+	}
+
+	// The session is removed once finished.
+	te.expect(http.StatusNotFound, "HEAD", u, tk, "", nil)
+
+	if ops := te.prop.getOps(); len(ops) != 1 || ops[0] != "put "+p {
+		t.Errorf("got propagations %v", ops)
+	}
+}
+
+func TestResumableUploadPreconditions(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	u := te.createUpload(tk, p, 5, map[string]string{"If-None-Match": "*"})
+
+	// The preconditions are evaluated again when the upload finishes.
+	te.expect(http.StatusCreated, "PUT", p, tk, "other", nil)
+	te.patchUpload(http.StatusPreconditionFailed, tk, u, 0, "hello")
+
+	w := te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if w.Body.String() != "other" {
+		t.Errorf("got %q, want %q", w.Body.String(), "other")
+	}
+	te.expect(http.StatusNotFound, "HEAD", u, tk, "", nil)
+
+	te.expect(http.StatusPreconditionFailed, "POST", p, tk, "",
+		map[string]string{"Upload-Length": "5", "If-None-Match": "*"})
+}
+
+func TestResumableUploadQuota(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.quota = 10
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+
+	// The length of the open sessions is reserved.
+	u := te.createUpload(tk, testHome+"/a", 8, nil)
+	te.expect(http.StatusInsufficientStorage, "PUT", testHome+"/b", tk, "123", nil)
+	te.expect(http.StatusInsufficientStorage, "POST", testHome+"/b", tk, "",
+		map[string]string{"Upload-Length": "3"})
+
+	if n := te.s.getReservedUploads(testHome); n != 8 {
+		t.Errorf("%d bytes reserved, want 8", n)
+	}
+
+	// The reservations are loaded from the sessions when the server starts.
+	te.s.uploadsMu.Lock()
+	te.s.uploadsReserved = map[string]*uploadSession{}
+	te.s.homesReserved = map[string]int64{}
+	te.s.uploadsMu.Unlock()
+	if err := te.s.loadUploadReservations(); err != nil {
+		t.Fatal(err)
+	}
+	if n := te.s.getReservedUploads(testHome); n != 8 {
+		t.Errorf("%d bytes reserved after restarting, want 8", n)
+	}
+
+	te.patchUpload(http.StatusNoContent, tk, u, 0, "12345678")
+	if n := te.s.getReservedUploads(testHome); n != 0 {
+		t.Errorf("%d bytes reserved after finishing, want 0", n)
+	}
+	te.expect(http.StatusCreated, "PUT", testHome+"/b", tk, "12", nil)
+}
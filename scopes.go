@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Tokens can be restricted with scopes and with a path prefix.
+//
+// The scope claim, a space separated list or a list of strings, limits
+// the methods: data:read allows GET and HEAD requests, data:write allows
+// the rest and COPY requests need both. Tokens without the scope claim
+// allow every method and scopes of other services are ignored.
+//
+// The path_prefix claim limits the requests to the prefix and the paths
+// below it, including the destinations of moves and copies. The endpoints
+// that work on the whole home, like the trash, are not available to
+// tokens with a path prefix.
+
+const (
+	scopeRead  = "data:read"
+	scopeWrite = "data:write"
+
+	scopeClaim      = "scope"
+	pathPrefixClaim = "path_prefix"
+)
+
+type tokenScope struct {
+	// all is true for tokens without the scope claim.
+	all    bool
+	read   bool
+	write  bool
+	prefix string
+}
+
+// getScopeFromClaims returns the scope of the claims of a token.
+func getScopeFromClaims(claims map[string]interface{}) (*tokenScope, error) {
+
+	sc := &tokenScope{}
+
+	var scopes []string
+	switch v := claims[scopeClaim].(type) {
+	case nil:
+		sc.all = true
+	case string:
+		scopes = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			s, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a list of strings: %v", scopeClaim, v)
+			}
+			scopes = append(scopes, s)
+		}
+	default:
+		return nil, fmt.Errorf("claim %s is not a string: %v", scopeClaim, v)
+	}
+
+	for _, s := range scopes {
+		switch s {
+		case scopeRead:
+			sc.read = true
+		case scopeWrite:
+			sc.write = true
+		}
+	}
+
+	if v, ok := claims[pathPrefixClaim]; ok {
+		prefix, ok := v.(string)
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("claim %s is not an absolute path: %v", pathPrefixClaim, v)
+		}
+		sc.prefix = path.Clean(prefix)
+	}
+
+	return sc, nil
+}
+
+func (sc *tokenScope) String() string {
+
+	scopes := []string{}
+	if sc.all {
+		scopes = append(scopes, "all")
+	}
+	if sc.read {
+		scopes = append(scopes, scopeRead)
+	}
+	if sc.write {
+		scopes = append(scopes, scopeWrite)
+	}
+
+	if sc.prefix == "" {
+		return fmt.Sprintf("scope(%s)", strings.Join(scopes, " "))
+	}
+	return fmt.Sprintf("scope(%s prefix:%s)", strings.Join(scopes, " "), sc.prefix)
+}
+
+// check checks that sc allows requests with method on p. The path is
+// not checked if p is empty.
+func (sc *tokenScope) check(method, p string) error {
+
+	if !sc.all {
+		switch strings.ToUpper(method) {
+		case "GET", "HEAD":
+			if !sc.read {
+				return fmt.Errorf("%s needs the %s scope", method, scopeRead)
+			}
+		case "COPY":
+			if !sc.read || !sc.write {
+				return fmt.Errorf("%s needs the %s and %s scopes", method, scopeRead, scopeWrite)
+			}
+		default:
+			if !sc.write {
+				return fmt.Errorf("%s needs the %s scope", method, scopeWrite)
+			}
+		}
+	}
+
+	if p != "" && sc.prefix != "" {
+		p = path.Clean(p)
+		if p != sc.prefix && !strings.HasPrefix(p, strings.TrimSuffix(sc.prefix, "/")+"/") {
+			return fmt.Errorf("%s is outside of %s", p, sc.prefix)
+		}
+	}
+
+	return nil
+}
+
+// scopeKey is the context key for the scope of the token.
+const scopeKey key = 3
+
+// newScopeContext returns a new Context carrying the scope of the token.
+func newScopeContext(ctx context.Context, sc *tokenScope) context.Context {
+	return context.WithValue(ctx, scopeKey, sc)
+}
+
+// fromScopeContext returns the scope of the token. It reports false for
+// requests authenticated without token, like pre-signed URLs.
+func fromScopeContext(ctx context.Context) (*tokenScope, bool) {
+	sc, ok := ctx.Value(scopeKey).(*tokenScope)
+	return sc, ok
+}
+
+// checkScope checks that the token found in ctx allows requests with
+// method on p.
+func checkScope(ctx context.Context, method, p string) error {
+	sc, ok := fromScopeContext(ctx)
+	if !ok {
+		return nil
+	}
+	return sc.check(method, p)
+}
+
+// checkHomeScope checks that the token found in ctx allows requests
+// with method on the whole home.
+func checkHomeScope(ctx context.Context, method string) error {
+
+	sc, ok := fromScopeContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	if sc.prefix != "" {
+		return fmt.Errorf("token restricted to %s", sc.prefix)
+	}
+
+	return sc.check(method, "")
+}
+
+// scopeHandler checks that the token allows the request on the path of
+// the request.
+func (s *server) scopeHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+
+	log := MustFromLogContext(ctx)
+
+	// The offset of a resumable upload is asked as part of the upload.
+	method := r.Method
+	if strings.ToUpper(method) == "HEAD" && r.URL.Query().Get("upload_id") != "" {
+		method = "PATCH"
+	}
+
+	if err := checkScope(ctx, method, getPathFromReq(r)); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	next(ctx, w, r)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestScopeCheck(t *testing.T) {
+
+	tests := []struct {
+		claims map[string]interface{}
+		method string
+		path   string
+		ok     bool
+	}{
+		{map[string]interface{}{}, "PUT", "/a", true},
+		{map[string]interface{}{"scope": "data:read"}, "GET", "/a", true},
+		{map[string]interface{}{"scope": "data:read"}, "HEAD", "/a", true},
+		{map[string]interface{}{"scope": "data:read"}, "PUT", "/a", false},
+		{map[string]interface{}{"scope": "data:read"}, "COPY", "/a", false},
+		{map[string]interface{}{"scope": "data:write"}, "GET", "/a", false},
+		{map[string]interface{}{"scope": "data:write"}, "DELETE", "/a", true},
+		{map[string]interface{}{"scope": "data:read data:write"}, "COPY", "/a", true},
+		{map[string]interface{}{"scope": []interface{}{"data:read", "data:write"}}, "COPY", "/a", true},
+		{map[string]interface{}{"path_prefix": "/a/b"}, "GET", "/a/b", true},
+		{map[string]interface{}{"path_prefix": "/a/b"}, "GET", "/a/b/c", true},
+		{map[string]interface{}{"path_prefix": "/a/b/"}, "GET", "/a/b/c", true},
+		{map[string]interface{}{"path_prefix": "/a/b"}, "GET", "/a/bc", false},
+		{map[string]interface{}{"path_prefix": "/a/b"}, "GET", "/a/b/../c", false},
+	}
+
+	for _, test := range tests {
+		sc, err := getScopeFromClaims(test.claims)
+		if err != nil {
+			t.Errorf("%v: %s", test.claims, err)
+			continue
+		}
+		err = sc.check(test.method, test.path)
+		if test.ok && err != nil {
+			t.Errorf("%v %s %s: %s", test.claims, test.method, test.path, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%v %s %s: allowed", test.claims, test.method, test.path)
+		}
+	}
+
+	for _, claims := range []map[string]interface{}{
+		{"scope": 1},
+		{"scope": []interface{}{"data:read", 1}},
+		{"path_prefix": "a/b"},
+	} {
+		if _, err := getScopeFromClaims(claims); err == nil {
+			t.Errorf("%v: invalid claims accepted", claims)
+		}
+	}
+}
+
+func TestScopedRequests(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.trash = true
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/docs/a.txt?create_parents=true", tk, "hello", nil)
+
+	read := newTestToken("ourense", map[string]interface{}{"scope": "data:read"})
+	te.expect(http.StatusOK, "GET", testHome+"/docs/a.txt", read, "", nil)
+	te.expect(http.StatusForbidden, "PUT", testHome+"/docs/a.txt", read, "bye", nil)
+	te.expect(http.StatusForbidden, "DELETE", testHome+"/docs/a.txt", read, "", nil)
+
+	prefixed := newTestToken("ourense", map[string]interface{}{"path_prefix": testHome + "/docs"})
+	te.expect(http.StatusCreated, "PUT", testHome+"/docs/b.txt", prefixed, "hello", nil)
+	te.expect(http.StatusForbidden, "PUT", testHome+"/b.txt", prefixed, "hello", nil)
+	te.expect(http.StatusForbidden, "MOVE", testHome+"/docs/b.txt", prefixed, "",
+		map[string]string{"Destination": testHome + "/b.txt"})
+	te.expect(http.StatusForbidden, "GET", trashEndPoint, prefixed, "", nil)
+}
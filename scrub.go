@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-data/proto/propagator"
+	"github.com/nu7hatch/gouuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scrubber walks the storage in the background reading every file
+// at a limited rate and compares its checksums with the ones saved in
+// its attributes or, for files saved without them, with the checksum
+// saved in the propagator, which is queried with the token of the service
+// and skipped if the service token file is not set. Mismatches are logged, the files are flagged
+// as corrupted and they are added to the quarantine list, which is kept
+// in the tmp dir.
+//
+// GET /scrub returns the status, the metrics and the quarantine list.
+// POST /scrub starts a new pass if the scrubber is idle.
+// DELETE /scrub?path=<path> removes a path from the quarantine list.
+//
+// The scrub endpoint is only available to the admins.
+
+const (
+	scrubEndPoint       = "/scrub"
+	scrubQuarantineFile = "scrub.quarantine"
+)
+
+type scrubMetrics struct {
+	Passes     int64 `json:"passes"`
+	Files      int64 `json:"files"`
+	Bytes      int64 `json:"bytes"`
+	Unverified int64 `json:"unverified"`
+	Mismatches int64 `json:"mismatches"`
+	Errors     int64 `json:"errors"`
+}
+
+type quarantineItem struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Found    int64  `json:"found"`
+}
+
+type scrubStatus struct {
+	Running    bool              `json:"running"`
+	LastStart  int64             `json:"last_start"`
+	LastEnd    int64             `json:"last_end"`
+	Metrics    scrubMetrics      `json:"metrics"`
+	Quarantine []*quarantineItem `json:"quarantine"`
+}
+
+type scrubber struct {
+	mu         sync.Mutex
+	fn         string
+	running    bool
+	lastStart  time.Time
+	lastEnd    time.Time
+	metrics    scrubMetrics
+	quarantine map[string]*quarantineItem
+}
+
+// newScrubber returns a scrubber with the quarantine list saved in fn.
+func newScrubber(fn string) (*scrubber, error) {
+
+	sc := &scrubber{}
+	sc.fn = fn
+	sc.quarantine = map[string]*quarantineItem{}
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return sc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*quarantineItem{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		sc.quarantine[item.Path] = item
+	}
+
+	return sc, nil
+}
+
+// start marks the scrubber as running. It reports false if it was
+// already running.
+func (sc *scrubber) start() bool {
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.running {
+		return false
+	}
+
+	sc.running = true
+	sc.lastStart = time.Now()
+	return true
+}
+
+func (sc *scrubber) finish() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.running = false
+	sc.lastEnd = time.Now()
+	sc.metrics.Passes++
+}
+
+func (sc *scrubber) update(fn func(m *scrubMetrics)) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	fn(&sc.metrics)
+}
+
+func (sc *scrubber) getStatus() *scrubStatus {
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	st := &scrubStatus{}
+	st.Running = sc.running
+	if !sc.lastStart.IsZero() {
+		st.LastStart = sc.lastStart.Unix()
+	}
+	if !sc.lastEnd.IsZero() {
+		st.LastEnd = sc.lastEnd.Unix()
+	}
+	st.Metrics = sc.metrics
+	st.Quarantine = []*quarantineItem{}
+	for _, item := range sc.quarantine {
+		st.Quarantine = append(st.Quarantine, item)
+	}
+
+	return st
+}
+
+// addToQuarantine adds item to the quarantine list replacing the
+// previous item for the same path.
+func (sc *scrubber) addToQuarantine(item *quarantineItem) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.quarantine[item.Path] = item
+	return sc.save()
+}
+
+// removeFromQuarantine removes p from the quarantine list. It reports
+// false if p was not in the list.
+func (sc *scrubber) removeFromQuarantine(p string) (bool, error) {
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if _, ok := sc.quarantine[p]; !ok {
+		return false, nil
+	}
+
+	delete(sc.quarantine, p)
+	return true, sc.save()
+}
+
+// save writes the quarantine list into its file. It must be called
+// with the lock held.
+func (sc *scrubber) save() error {
+
+	items := []*quarantineItem{}
+	for _, item := range sc.quarantine {
+		items = append(items, item)
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	tmpFn := sc.fn + ".tmp"
+	if err := ioutil.WriteFile(tmpFn, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFn, sc.fn)
+}
+
+// scrubForever runs a scrubbing pass every scrubInterval.
+func (s *server) scrubForever() {
+
+	ticker := time.NewTicker(s.p.scrubInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.scrub.start() {
+			s.runScrub()
+		}
+		<-ticker.C
+	}
+}
+
+// runScrub walks the whole storage once. The scrubber must be started.
+func (s *server) runScrub() {
+
+	defer s.scrub.finish()
+
+	_uuid, err := uuid.NewV4()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	reqLogger := log.WithField("trace", "scrub-"+_uuid.String())
+	ctx := NewLogContext(context.Background(), reqLogger)
+	ctx = newGRPCTraceContext(ctx, _uuid.String())
+
+	reqLogger.Info("scrubbing started")
+
+	limiter := &rateLimiter{rate: s.p.scrubRate, start: time.Now()}
+	if err := s.scrubTree(ctx, "/", limiter); err != nil {
+		reqLogger.Error(err)
+	}
+
+	st := s.scrub.getStatus()
+	reqLogger.WithFields(log.Fields{
+		"files":      st.Metrics.Files,
+		"bytes":      st.Metrics.Bytes,
+		"mismatches": st.Metrics.Mismatches,
+		"errors":     st.Metrics.Errors,
+		"quarantine": len(st.Quarantine),
+	}).Info("scrubbing finished")
+}
+
+// scrubTree scrubs the files below p. The data keys are not scrubbed
+// as they are not user data and the blobs are scrubbed through the
+// files that reference them.
+func (s *server) scrubTree(ctx context.Context, p string, limiter *rateLimiter) error {
+
+	log := MustFromLogContext(ctx)
+
+	if p == keysRoot || p == blobsRoot {
+		return nil
+	}
+
+	infos, err := s.storage.ReadDir(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		child := path.Join(p, info.Name())
+
+		if info.IsDir() {
+			if err := s.scrubTree(ctx, child, limiter); err != nil {
+				log.Error(err)
+				s.scrub.update(func(m *scrubMetrics) { m.Errors++ })
+			}
+			continue
+		}
+
+		if err := s.scrubFile(ctx, child, limiter); err != nil {
+			log.Errorf("cannot scrub %s: %s", child, err)
+			s.scrub.update(func(m *scrubMetrics) { m.Errors++ })
+		}
+	}
+
+	return nil
+}
+
+// scrubFile compares the checksums of p with the saved ones.
+func (s *server) scrubFile(ctx context.Context, p string, limiter *rateLimiter) error {
+
+	log := MustFromLogContext(ctx)
+
+	attrs, err := s.getAttrs(p)
+	if err != nil {
+		return err
+	}
+
+	expected := attrs.checksums
+	if len(expected) == 0 {
+		chk, err := s.getPropagatedChecksum(ctx, p)
+		if err != nil {
+			return err
+		}
+		if chk != nil {
+			expected = []*checksum{chk}
+		}
+	}
+
+	if len(expected) == 0 {
+		s.scrub.update(func(m *scrubMetrics) { m.Unverified++ })
+		return nil
+	}
+
+	fd, err := s.storage.Open(p)
+	if os.IsNotExist(err) {
+		// Removed while scrubbing.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	types := []string{}
+	for _, c := range expected {
+		types = append(types, c.Type)
+	}
+
+	hashers, err := newHashers(types...)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(hashers, limiter.reader(fd))
+	s.scrub.update(func(m *scrubMetrics) {
+		m.Files++
+		m.Bytes += n
+	})
+	if err != nil {
+		return err
+	}
+
+	chk := expected[0]
+	actual := hashers.get(chk.Type)
+	if hashers.verify(expected...) == nil {
+		// Files fixed since they were found corrupted leave the quarantine.
+		_, err := s.scrub.removeFromQuarantine(p)
+		return err
+	}
+
+	// A file replaced while it was read does not match the checksums
+	// read before.
+	if s.isChangedSince(p, info, attrs) {
+		log.Infof("%s changed while scrubbing", p)
+		return nil
+	}
+
+	log.Errorf("%s is corrupted: expected %s and got %s", p, chk.String(), actual.String())
+	s.scrub.update(func(m *scrubMetrics) { m.Mismatches++ })
+
+	if err := s.flagCorrupted(p); err != nil {
+		log.Error(err)
+	}
+
+	item := &quarantineItem{}
+	item.Path = p
+	item.Expected = chk.String()
+	item.Actual = actual.String()
+	item.Found = time.Now().Unix()
+	return s.scrub.addToQuarantine(item)
+}
+
+// isChangedSince reports if p is not the file described by info
+// and attrs anymore.
+func (s *server) isChangedSince(p string, info os.FileInfo, attrs *fileAttrs) bool {
+
+	current, err := s.storage.Stat(p)
+	if err != nil {
+		return true
+	}
+
+	if !current.ModTime().Equal(info.ModTime()) || current.Size() != info.Size() {
+		return true
+	}
+
+	currentAttrs, err := s.getAttrs(p)
+	if err != nil {
+		return true
+	}
+
+	return !currentAttrs.uploaded.Equal(attrs.uploaded)
+}
+
+// getPropagatedChecksum returns the checksum of p saved in the propagator
+// or nil if there is none or there is no token of the service to get it.
+// Only files in the homes are saved in the propagator.
+func (s *server) getPropagatedChecksum(ctx context.Context, p string) (*checksum, error) {
+
+	if s.p.prop == "" || !strings.HasPrefix(p, "/local/users/") {
+		return nil, nil
+	}
+
+	if getOwner(p) == "" {
+		return nil, nil
+	}
+
+	token, err := s.getServiceToken()
+	if err == errNoServiceToken {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	con, err := grpc.Dial(s.p.prop, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	client := pb.NewPropClient(con)
+
+	ctx, cancel := context.WithTimeout(ctx, propagatorTimeout)
+	defer cancel()
+
+	in := &pb.GetReq{}
+	in.Path = p
+	in.AccessToken = token
+
+	rec, err := client.Get(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(rec.Checksum, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+
+	t := strings.ToLower(parts[0])
+	if _, ok := checksumTypes[t]; !ok {
+		return nil, nil
+	}
+
+	return &checksum{t, parts[1]}, nil
+}
+
+// scrubHandler handles the requests to the scrub endpoint.
+func (s *server) scrubHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	if !s.isAdmin(idt) {
+		log.Warnf("%s is not an admin", *idt)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if err := checkHomeScope(ctx, r.Method); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	switch strings.ToUpper(r.Method) {
+	case "GET":
+		log.WithField("op", "scrub-status").Info()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.scrub.getStatus()); err != nil {
+			log.Error(err)
+		}
+	case "POST":
+		log.WithField("op", "scrub-start").Info()
+		if !s.scrub.start() {
+			log.Error("the scrubber is already running")
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+		go s.runScrub()
+		w.WriteHeader(http.StatusAccepted)
+	case "DELETE":
+		log.WithField("op", "scrub-release").Info()
+		p := path.Clean(r.URL.Query().Get("path"))
+		found, err := s.scrub.removeFromQuarantine(p)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			log.Errorf("%s is not in quarantine", p)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// isAdmin reports if idt is one of the admins, given as <idp>/<pid>
+// or <pid>.
+func (s *server) isAdmin(idt *authlib.Identity) bool {
+	for _, admin := range s.p.admins {
+		if admin == idt.Pid || admin == idt.Idp+"/"+idt.Pid {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter limits the bytes read per second by the readers it returns.
+// No limit is applied if rate is not positive.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	mu    sync.Mutex
+	n     int64
+}
+
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l.rate <= 0 {
+		return r
+	}
+	return &rateLimitedReader{r, l}
+}
+
+// wait sleeps until reading n more bytes does not exceed the rate.
+func (l *rateLimiter) wait(n int) {
+
+	l.mu.Lock()
+	l.n += int64(n)
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if d := due.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type rateLimitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+
+	// Read at most a tenth of a second worth of data at once
+	// so the reads are spread over time.
+	if max := r.l.rate/10 + 1; int64(len(b)) > max {
+		b = b[:max]
+	}
+
+	n, err := r.r.Read(b)
+	r.l.wait(n)
+	return n, err
+}
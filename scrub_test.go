@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newScrubTestEnv(t *testing.T, mod func(p *newServerParams)) *testEnv {
+	return newTestEnv(t, func(p *newServerParams) {
+		p.checksums = []string{"md5"}
+		p.admins = []string{"local/ourense"}
+		if mod != nil {
+			mod(p)
+		}
+	})
+}
+
+// scrub runs a pass of the scrubber and returns its status.
+func (te *testEnv) scrub() *scrubStatus {
+
+	if !te.s.scrub.start() {
+		te.t.Fatal("the scrubber is running")
+	}
+	te.s.runScrub()
+
+	w := te.expect(http.StatusOK, "GET", scrubEndPoint, newTestToken("ourense", nil), "", nil)
+
+	st := &scrubStatus{}
+	if err := json.NewDecoder(w.Body).Decode(st); err != nil {
+		te.t.Fatal(err)
+	}
+	return st
+}
+
+// removeTestAttrs removes the attributes of p in the memory backend of te.
+func (te *testEnv) removeTestAttrs(p string) {
+	m := te.s.storage.(*memoryStorage)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[p].attrs = nil
+}
+
+func TestScrub(t *testing.T) {
+
+	te := newScrubTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	a, b := testHome+"/a.txt", testHome+"/b.txt"
+
+	te.expect(http.StatusCreated, "PUT", a, tk, "hello", nil)
+	te.expect(http.StatusCreated, "PUT", b+"?checksum=md5:5d41402abc4b2a76b9719d911017c592", tk, "hello", nil)
+
+	st := te.scrub()
+	if st.Metrics.Files != 2 || st.Metrics.Mismatches != 0 || len(st.Quarantine) != 0 {
+		t.Errorf("got status %+v after scrubbing good files", st)
+	}
+
+	te.corruptTestFile(a)
+
+	// Files without attributes are compared with the propagator.
+	te.corruptTestFile(b)
+	te.removeTestAttrs(b)
+
+	st = te.scrub()
+	if st.Metrics.Mismatches != 2 || len(st.Quarantine) != 2 {
+		t.Fatalf("got status %+v after scrubbing corrupted files", st)
+	}
+	for _, item := range st.Quarantine {
+		if item.Expected != "md5:5d41402abc4b2a76b9719d911017c592" {
+			t.Errorf("%s: expected %s", item.Path, item.Expected)
+		}
+	}
+
+	// The propagator is queried with the token of the service.
+	tokens := te.prop.getTokens()
+	if tokens[len(tokens)-1] != testServiceToken {
+		t.Errorf("propagator queried with token %q, want the service token", tokens[len(tokens)-1])
+	}
+
+	attrs, err := te.s.getAttrs(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.corrupted.IsZero() {
+		t.Error("corrupted file not flagged")
+	}
+
+	// Only admins can see the status and release files.
+	q := url.Values{"path": {a}}.Encode()
+	te.expect(http.StatusForbidden, "GET", scrubEndPoint, newTestToken("bob", nil), "", nil)
+	te.expect(http.StatusForbidden, "DELETE", scrubEndPoint+"?"+q, newTestToken("bob", nil), "", nil)
+	te.expect(http.StatusNoContent, "DELETE", scrubEndPoint+"?"+q, tk, "", nil)
+	te.expect(http.StatusNotFound, "DELETE", scrubEndPoint+"?"+q, tk, "", nil)
+
+	// Fixed files leave the quarantine.
+	te.expect(http.StatusCreated, "PUT", b, tk, "hello", nil)
+	if st := te.scrub(); len(st.Quarantine) != 1 || st.Quarantine[0].Path != a {
+		t.Errorf("got quarantine %v, want %s", st.Quarantine, a)
+	}
+}
+
+func TestScrubWithoutServiceToken(t *testing.T) {
+
+	te := newScrubTestEnv(t, func(p *newServerParams) {
+		p.svcTokenFile = ""
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	te.expect(http.StatusCreated, "PUT", p+"?checksum=md5:5d41402abc4b2a76b9719d911017c592", tk, "hello", nil)
+	te.corruptTestFile(p)
+	te.removeTestAttrs(p)
+
+	st := te.scrub()
+	if st.Metrics.Unverified != 1 || st.Metrics.Mismatches != 0 || st.Metrics.Errors != 0 {
+		t.Errorf("got status %+v, want one unverified file", st)
+	}
+	for _, op := range te.prop.getOps() {
+		if op == "get "+p {
+			t.Error("propagator queried without the token of the service")
+		}
+	}
+}
@@ -1,50 +1,178 @@
 package main
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
 	"fmt"
 	authlib "github.com/clawio/service-auth/lib"
 	"github.com/clawio/service-localfs-data/lib"
-	pb "github.com/clawio/service-localfs-data/proto/propagator"
 	log "github.com/sirupsen/logrus"
 	"github.com/zenazn/goji/web/mutil"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
-	"hash"
-	"hash/adler32"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
 	dirPerm = 0755
+
+	propagatorTimeout = 10 * time.Second
 )
 
 type newServerParams struct {
-	dataDir      string
-	tmpDir       string
-	checksum     string
-	prop         string
-	sharedSecret string
+	dataDir       string
+	tmpDir        string
+	checksums     []string
+	prop          string
+	backend       string
+	maxUpload     int64
+	uploadAge     time.Duration
+	quota         int64
+	quotaFile     string
+	versions      int
+	versionsAge   time.Duration
+	trash         bool
+	trashAge      time.Duration
+	dedup         bool
+	keyFile       string
+	compress      bool
+	verify        string
+	scrubInterval time.Duration
+	scrubRate     int64
+	admins        []string
+	share         string
+	shareCache    time.Duration
+	presignKey    string
+	presignMaxAge time.Duration
+	links         bool
+	jwtAlgs       []string
+	jwksFile      string
+	jwtAudience   string
+	jwtIssuer     string
+	jwtLeeway     time.Duration
+	jwtRequireExp bool
+	svcTokenFile  string
+	sharedSecret  string
 }
 
 func newServer(p *newServerParams) (*server, error) {
 
 	s := &server{}
 	s.p = p
+	s.uploadsBusy = map[string]bool{}
+	s.uploadsReserved = map[string]*uploadSession{}
+	s.homesReserved = map[string]int64{}
+	s.pathLocks = map[string]*pathLock{}
+
+	storage, err := newStorage(p)
+	if err != nil {
+		return nil, err
+	}
+	s.storage = storage
+
+	tokens, err := newTokenValidator(p)
+	if err != nil {
+		return nil, err
+	}
+	s.tokens = tokens
+
+	if p.keyFile != "" {
+		cs, err := newCryptStorage(storage, p.keyFile, p.tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		s.storage = cs
+	}
+
+	// Files are compressed before being encrypted.
+	if p.compress {
+		s.storage = newCompressStorage(s.storage, p.tmpDir)
+	}
+
+	quota, err := newQuotaManager(p.quota, p.quotaFile, s.storage)
+	if err != nil {
+		return nil, err
+	}
+	s.quota = quota
+
+	j, err := newJournal(path.Join(p.tmpDir, journalFile), path.Join(p.tmpDir, journalFailedFile))
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+
+	go s.retryPropagations()
+
+	if err := s.loadUploadReservations(); err != nil {
+		return nil, err
+	}
+
+	if p.uploadAge > 0 {
+		go s.expireUploads()
+	}
+
+	if p.trash && p.trashAge > 0 {
+		go s.expireTrash()
+	}
+
+	if p.versionsAge > 0 {
+		go s.expireVersions()
+	}
+
+	if ds, ok := storage.(*dedupStorage); ok {
+		go ds.collectGarbage()
+	}
+
+	if p.share != "" {
+		s.shares = newShareResolver(p.share, p.shareCache)
+		go s.shares.expireGrants()
+	}
+
+	if p.links {
+		links, err := newLinkStore(path.Join(p.tmpDir, linksFile))
+		if err != nil {
+			return nil, err
+		}
+		s.links = links
+	}
+
+	sc, err := newScrubber(path.Join(p.tmpDir, scrubQuarantineFile))
+	if err != nil {
+		return nil, err
+	}
+	s.scrub = sc
+
+	if p.scrubInterval > 0 {
+		go s.scrubForever()
+	}
 
 	return s, nil
 }
 
 type server struct {
-	p *newServerParams
+	p       *newServerParams
+	storage storage
+	quota   *quotaManager
+	scrub   *scrubber
+	shares  *shareResolver
+	links   *linkStore
+	tokens  *tokenValidator
+
+	uploadsMu       sync.Mutex
+	uploadsBusy     map[string]bool
+	uploadsReserved map[string]*uploadSession
+	homesReserved   map[string]int64
+
+	pathsMu   sync.Mutex
+	pathLocks map[string]*pathLock
+
+	journal *journal
 }
 
 func (s *server) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -85,12 +213,71 @@ func (s *server) ServeHTTPC(ctx context.Context, w http.ResponseWriter, r *http.
 
 	}()
 
-	if strings.ToUpper(r.Method) == "PUT" {
+	if p := getPathFromReq(r); p == trashEndPoint || strings.HasPrefix(p, trashEndPoint+"/") {
+		if !s.p.trash {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.identityHandler(ctx, lw, r, s.trash)
+	} else if getPathFromReq(r) == scrubEndPoint {
+		s.identityHandler(ctx, lw, r, s.scrubHandler)
+	} else if getPathFromReq(r) == presignEndPoint {
+		if s.p.presignMaxAge <= 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.identityHandler(ctx, lw, r, s.presign)
+	} else if p := getPathFromReq(r); p == linksEndPoint || strings.HasPrefix(p, linksEndPoint+"/") {
+		if s.links == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.identityHandler(ctx, lw, r, s.linksHandler)
+	} else if strings.ToUpper(r.Method) == "PUT" {
 		reqLogger.WithField("op", "upload").Info()
 		s.authHandler(ctx, lw, r, s.upload)
 	} else if strings.ToUpper(r.Method) == "GET" {
-		reqLogger.WithField("op", "download").Info()
-		s.authHandler(ctx, lw, r, s.download)
+		if _, ok := r.URL.Query()["versions"]; ok {
+			reqLogger.WithField("op", "list-versions").Info()
+			s.authHandler(ctx, lw, r, s.listVersions)
+		} else if r.URL.Query().Get("version") != "" {
+			reqLogger.WithField("op", "download-version").Info()
+			s.authHandler(ctx, lw, r, s.downloadVersion)
+		} else {
+			reqLogger.WithField("op", "download").Info()
+			s.authHandler(ctx, lw, r, s.download)
+		}
+	} else if strings.ToUpper(r.Method) == "POST" {
+		if r.URL.Query().Get("restore_version") != "" {
+			reqLogger.WithField("op", "restore-version").Info()
+			s.authHandler(ctx, lw, r, s.restoreVersion)
+		} else {
+			reqLogger.WithField("op", "create-upload").Info()
+			s.authHandler(ctx, lw, r, s.createUpload)
+		}
+	} else if strings.ToUpper(r.Method) == "PATCH" {
+		reqLogger.WithField("op", "patch-upload").Info()
+		s.authHandler(ctx, lw, r, s.patchUpload)
+	} else if strings.ToUpper(r.Method) == "HEAD" {
+		if r.URL.Query().Get("upload_id") != "" {
+			reqLogger.WithField("op", "head-upload").Info()
+			s.authHandler(ctx, lw, r, s.headUpload)
+		} else {
+			reqLogger.WithField("op", "download").Info()
+			s.authHandler(ctx, lw, r, s.download)
+		}
+	} else if strings.ToUpper(r.Method) == "DELETE" {
+		reqLogger.WithField("op", "remove").Info()
+		s.authHandler(ctx, lw, r, s.remove)
+	} else if strings.ToUpper(r.Method) == "MOVE" {
+		reqLogger.WithField("op", "move").Info()
+		s.authHandler(ctx, lw, r, s.move)
+	} else if strings.ToUpper(r.Method) == "COPY" {
+		reqLogger.WithField("op", "copy").Info()
+		s.authHandler(ctx, lw, r, s.copy)
+	} else if strings.ToUpper(r.Method) == "MKCOL" {
+		reqLogger.WithField("op", "mkcol").Info()
+		s.authHandler(ctx, lw, r, s.mkcol)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -102,9 +289,71 @@ func (s *server) upload(ctx context.Context, w http.ResponseWriter, r *http.Requ
 	log := MustFromLogContext(ctx)
 	p := lib.MustFromContext(ctx)
 
-	pp := s.getPhysicalPath(p)
+	maxUpload := s.getMaxUpload(ctx)
+
+	if maxUpload > 0 && r.ContentLength > maxUpload {
+		log.Errorf("upload of %d bytes exceeds the maximum of %d bytes",
+			r.ContentLength, maxUpload)
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// available is -1 if the user has no quota.
+	available, err := s.getAvailable(authlib.MustFromContext(ctx))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if available >= 0 {
+		// The bytes of the file being replaced are freed.
+		if info, err := s.storage.Stat(p); err == nil && !info.IsDir() {
+			available += info.Size()
+		}
+
+		if r.ContentLength > available {
+			log.Errorf("upload of %d bytes exceeds the %d bytes available",
+				r.ContentLength, available)
+			http.Error(w, "", http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	chks, err := s.getChecksumsFromReq(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, chk := range chks {
+		log.Infof("file sent with checksum %s", chk.String())
+	}
+
+	// The checksums sent by the client are computed along with the
+	// ones configured for the server.
+	hashers, err := s.newHashers(chks...)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	log.Infof("physical path is %s", pp)
+	if !s.isParentDir(ctx, p) {
+		if !getCreateParentsFromReq(r) {
+			log.Errorf("parent of %s does not exist", p)
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+
+		err := s.mkdirAll(ctx, path.Dir(p))
+		if err != nil && err != errPropagationPending {
+			log.Error(err)
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+	}
 
 	tmpFn, tmpFile, err := s.tmpFile()
 	if err != nil {
@@ -115,120 +364,567 @@ func (s *server) upload(ctx context.Context, w http.ResponseWriter, r *http.Requ
 
 	log.Infof("created tmp file %s", tmpFn)
 
-	var mw io.Writer
-	var hasher hash.Hash
-	var isChecksumed bool
-	var computedChecksum string
-
-	switch s.p.checksum {
-	case "md5":
-		hasher = md5.New()
-		isChecksumed = true
-		mw = io.MultiWriter(tmpFile, hasher)
-	case "sha1":
-		hasher = sha1.New()
-		isChecksumed = true
-		mw = io.MultiWriter(tmpFile, hasher)
-	case "adler32":
-		hasher = adler32.New()
-		isChecksumed = true
-		mw = io.MultiWriter(tmpFile, hasher)
-	default:
-		mw = io.MultiWriter(tmpFile)
-	}
-
-	// TODO(labkode) Sometimes ContentLength = -1 because it is a binary
-	// upload with TransferEncoding: chunked.
-	// Instead using Copy we shoudl use a LimitedReader with a max file upload
-	// configuration value.
-	_, err = io.Copy(mw, r.Body)
+	mw := io.MultiWriter(tmpFile, hashers)
+
+	// ContentLength is -1 for uploads with Transfer-Encoding: chunked,
+	// so the body is also limited while it is copied.
+	var body io.Reader = r.Body
+	if maxUpload > 0 {
+		body = io.LimitReader(body, maxUpload+1)
+	}
+	if available >= 0 {
+		body = io.LimitReader(body, available+1)
+	}
+
+	n, err := io.Copy(mw, body)
 	if err != nil {
 		log.Error(err)
+		tmpFile.Close()
+		os.Remove(tmpFn)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	chk := s.getChecksumInfo(r)
+	if maxUpload > 0 && n > maxUpload {
+		log.Errorf("upload exceeds the maximum of %d bytes", maxUpload)
+		tmpFile.Close()
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
 
-	if isChecksumed {
-		log.Infof("file sent with checksum %s", chk.String())
+	if available >= 0 && n > available {
+		log.Errorf("upload exceeds the %d bytes available", available)
+		tmpFile.Close()
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	}
+
+	if r.ContentLength >= 0 && n != r.ContentLength {
+		log.Errorf("received %d bytes but Content-Length is %d", n, r.ContentLength)
+		tmpFile.Close()
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := hashers.verify(chks...); err != nil {
+		log.Error(err)
+		tmpFile.Close()
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+
+	log.Infof("copied r.Body into tmp file %s", tmpFn)
+
+	err = tmpFile.Close()
+	if err != nil {
+		log.Error(err)
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("closed tmp file %s", tmpFn)
+
+	status := http.StatusCreated
+
+	computed := hashers.getAll()
+
+	precond := func(info os.FileInfo) bool {
+		return checkPutPreconditions(r, info)
+	}
+
+	if err := s.commit(ctx, tmpFn, p, getFirstChecksum(chks), computed, precond); err == errPropagationPending {
+		// The data is saved but the metadata is not in sync yet.
+		status = http.StatusAccepted
+	} else if err == errPreconditionFailed {
+		log.Errorf("preconditions failed for %s", p)
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	} else if err == errQuotaExceeded {
+		log.Error(err)
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
+		log.Error(err)
+		os.Remove(tmpFn)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if info, err := s.storage.Stat(p); err == nil {
+		w.Header().Set("ETag", getETag(info))
+	}
+
+	setChecksumHeaders(w, computed)
+
+	w.WriteHeader(status)
+}
+
+// commit moves the tmp file tmpFn to p and saves p into the propagator.
+// If precond is not nil it is called with the current state of p, nil if
+// p does not exist, holding the lock of p and errPreconditionFailed is
+// returned if it reports false.
+// If the user does not have enough quota errQuotaExceeded is returned.
+// If the propagator cannot be reached errPropagationPending is returned
+// and the propagation is retried in the background.
+func (s *server) commit(ctx context.Context, tmpFn, p string, chk *checksum, computed []*checksum,
+	precond func(info os.FileInfo) bool) error {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	tmpInfo, err := os.Stat(tmpFn)
+	if err != nil {
+		return err
+	}
+
+	e := &journalEntry{}
+	e.Op = journalOpPut
+	e.Path = p
+	e.TmpFn = tmpFn
+	e.Checksum = chk.String()
+
+	return s.journaled(ctx, e, func() error {
+		info, err := s.storage.Stat(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil {
+			info = nil
+		}
+
+		if precond != nil && !precond(info) {
+			return errPreconditionFailed
+		}
+
+		delta := tmpInfo.Size()
+		if info != nil && !info.IsDir() {
+			delta -= info.Size()
+		}
+
+		if err := s.quota.reserve(idt, delta); err != nil {
+			return err
+		}
+
+		vp, err := s.saveVersion(ctx, p)
+		if err != nil {
+			s.quota.release(idt, delta)
+			return err
+		}
+		if err := s.commitToStorage(tmpFn, p, computed); err != nil {
+			if vp != "" {
+				s.storage.Rename(vp, p)
+			}
+			s.quota.release(idt, delta)
+			return err
+		}
+		log.Infof("committed tmp file %s to %s", tmpFn, p)
+
+		// The file is saved even if the attributes cannot be saved.
+		if err := s.saveAttrs(p, computed); err != nil {
+			log.Errorf("cannot save attributes of %s: %s", p, err)
+		}
+		return nil
+	})
+}
+
+// commitToStorage commits tmpFn to p giving computed to the backends
+// that can make use of it.
+func (s *server) commitToStorage(tmpFn, p string, computed []*checksum) error {
+	if cc, ok := s.storage.(checksumCommitter); ok {
+		return cc.CommitChecksum(tmpFn, p, computed)
+	}
+	return s.storage.Commit(tmpFn, p)
+}
+
+// removeAll removes p and its contents from the storage and
+// frees the quota used by them.
+func (s *server) removeAll(ctx context.Context, p string) error {
+
+	size, err := getTreeSize(s.storage, p)
+	if err != nil {
+		return err
+	}
+
+	versions := s.getTreeVersionsDirs(ctx, p)
+
+	if err := s.storage.RemoveAll(p); err != nil {
+		return err
+	}
+
+	s.quota.release(authlib.MustFromContext(ctx), size)
+	s.removeVersionsDirs(ctx, versions)
+	return nil
+}
+
+// mkdir creates the directory p and saves it into the propagator.
+// If the propagator cannot be reached errPropagationPending is returned
+// and the propagation is retried in the background.
+func (s *server) mkdir(ctx context.Context, p string) error {
+
+	log := MustFromLogContext(ctx)
+
+	e := &journalEntry{}
+	e.Op = journalOpPut
+	e.Path = p
+
+	return s.journaled(ctx, e, func() error {
+		if err := s.storage.Mkdir(p); err != nil {
+			return err
+		}
+		log.Infof("created directory %s", p)
+		return nil
+	})
+}
+
+// isParentDir reports if the parent of p exists and is a directory.
+// The home directory is managed outside this service so it is
+// assumed to exist.
+func (s *server) isParentDir(ctx context.Context, p string) bool {
+
+	dir := path.Dir(p)
 
-		// checksums are given in hexadecimal format.
-		computedChecksum = fmt.Sprintf("%x", string(hasher.Sum(nil)))
+	if dir == getHome(authlib.MustFromContext(ctx)) {
+		return true
+	}
+
+	info, err := s.storage.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// mkdirAll creates the directory p and the parents that do not exist
+// yet below the home directory, saving each of them into the propagator.
+func (s *server) mkdirAll(ctx context.Context, p string) error {
+
+	idt := authlib.MustFromContext(ctx)
+	home := getHome(idt)
+
+	if p == home || !isUnderHome(p, idt) {
+		return nil
+	}
+
+	info, err := s.storage.Stat(p)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", p)
+		}
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = s.mkdirAll(ctx, path.Dir(p))
+	if err != nil && err != errPropagationPending {
+		return err
+	}
 
-		if chk.Type == s.p.checksum && chk.Type != "" {
+	return s.mkdir(ctx, p)
+}
+
+// newHashers returns the hashers for the checksums configured for the
+// server and for chks, the checksums sent by the client.
+func (s *server) newHashers(chks ...*checksum) (*hashers, error) {
+
+	h, err := newHashers(s.p.checksums...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chk := range chks {
+		if err := h.add(chk.Type); err != nil {
+			return nil, err
+		}
+	}
 
-			isCorrupted := computedChecksum != chk.Sum
+	return h, nil
+}
 
-			if isCorrupted {
-				log.Errorf("corrupted file. expected %s and got %s",
-					s.p.checksum+":"+computedChecksum, chk.Sum)
-				http.Error(w, "", http.StatusPreconditionFailed)
+// getFirstChecksum returns the first checksum of chks or nil.
+// It is the one saved into the propagator.
+func getFirstChecksum(chks []*checksum) *checksum {
+	if len(chks) == 0 {
+		return nil
+	}
+	return chks[0]
+}
+
+// setChecksumHeaders adds a CIO-Checksum header with every checksum
+// in checksums.
+func setChecksumHeaders(w http.ResponseWriter, checksums []*checksum) {
+	for _, c := range checksums {
+		w.Header().Add("CIO-Checksum", c.String())
+	}
+}
+
+// getAttrsOrEmpty returns the attributes of p. Files can be served
+// without them, so errors are only logged.
+func (s *server) getAttrsOrEmpty(ctx context.Context, p string) *fileAttrs {
+
+	log := MustFromLogContext(ctx)
+
+	attrs, err := s.getAttrs(p)
+	if err != nil {
+		log.Errorf("cannot get attributes of %s: %s", p, err)
+		return &fileAttrs{}
+	}
+
+	return attrs
+}
+
+func (s *server) download(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	s.serveFile(ctx, w, r, lib.MustFromContext(ctx))
+}
+
+// serveFile writes the contents of the file p into w.
+func (s *server) serveFile(ctx context.Context, w http.ResponseWriter, r *http.Request, p string) {
+
+	log := MustFromLogContext(ctx)
+
+	if eo, ok := s.storage.(encodedOpener); ok {
+		fd, enc, err := eo.OpenEncoded(p)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if enc != "" {
+			w.Header().Set("Vary", "Accept-Encoding")
+			if acceptsEncoding(r, enc) {
+				defer fd.Close()
+				s.serveEncodedFile(ctx, w, r, p, fd, enc)
 				return
 			}
+			fd.Close()
 		}
 	}
 
-	log.Infof("copied r.Body into tmp file %s", tmpFn)
+	fd, err := s.storage.Open(p)
+	if os.IsNotExist(err) {
+		log.Error(err.Error())
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
 
-	err = tmpFile.Close()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
+	defer fd.Close()
 
-	log.Infof("closed tmp file %s", tmpFn)
+	log.Infof("opened %s", p)
 
-	if err = os.Rename(tmpFn, pp); err != nil {
+	info, err := fd.Stat()
+	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("renamed tmp file %s to %s", tmpFn, pp)
+	log.Infof("stated %s got size %d", p, info.Size())
 
-	con, err := grpc.Dial(s.p.prop, grpc.WithInsecure())
-	if err != nil {
+	if info.IsDir() {
+		log.Errorf("%s is a directory", p)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	attrs := s.getAttrsOrEmpty(ctx, p)
+
+	if !s.verifyFile(ctx, w, p, fd, attrs) {
+		return
+	}
+
+	if err := setDigestHeader(w, r, fd, attrs.checksums); err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
-	defer con.Close()
 
-	log.Infof("created connection to %s", s.p.prop)
+	setAttrHeaders(w, attrs)
 
-	client := pb.NewPropClient(con)
+	// The ETag header must be set before calling ServeContent so
+	// If-Match, If-None-Match and If-Range are evaluated against it.
+	// If-Modified-Since is evaluated against the modification time.
+	w.Header().Set("ETag", getETag(info))
 
-	in := &pb.PutReq{}
-	in.Path = p
-	in.AccessToken = authlib.MustFromTokenContext(ctx)
-	in.Checksum = chk.String()
+	// ServeContent takes care of the Range header (single and multiple
+	// ranges), answering with 206 Partial Content, multipart/byteranges
+	// or 416 Requested Range Not Satisfiable when needed.
+	// It also sets the Accept-Ranges and Content-Length headers.
+	http.ServeContent(w, r, path.Base(p), info.ModTime(), fd)
+
+	log.Infof("copied %s to res.body", p)
+}
+
+// serveEncodedFile sends fd, the contents of p encoded with enc, as they are.
+// Ranges refer to the encoded contents.
+func (s *server) serveEncodedFile(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	p string, fd storageFile, enc string) {
+
+	log := MustFromLogContext(ctx)
 
-	_, err = client.Put(ctx, in)
+	info, err := fd.Stat()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("saved path %s into %s", p, s.p.prop)
+	// ServeContent would detect the type of the encoded contents.
+	ct := mime.TypeByExtension(path.Ext(p))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	attrs := s.getAttrsOrEmpty(ctx, p)
 
-	w.WriteHeader(http.StatusCreated)
+	// The saved checksums are verified against the decoded contents.
+	if s.p.verify != "" {
+		decoded, err := s.storage.Open(p)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		ok := s.verifyFile(ctx, w, p, decoded, attrs)
+		decoded.Close()
+		if !ok {
+			return
+		}
+	}
+
+	// The digest of an encoded file is computed on the encoded contents.
+	if err := setDigestHeader(w, r, fd, nil); err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	setAttrHeaders(w, attrs)
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Set("ETag", getEncodedETag(info, enc))
+
+	http.ServeContent(w, r, path.Base(p), info.ModTime(), fd)
+
+	log.Infof("copied %s encoded with %s to res.body", p, enc)
 }
 
-func (s *server) download(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// remove deletes the file or directory found in ctx.
+// Directories are only removed with their contents if the
+// request carries the Depth: infinity header, otherwise they must be empty.
+// If the trash is enabled the path is moved into the trash.
+func (s *server) remove(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 
 	log := MustFromLogContext(ctx)
 	p := lib.MustFromContext(ctx)
 
-	pp := s.getPhysicalPath(p)
+	info, err := s.storage.Stat(p)
+	if os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
 
-	log.Info("physical path is %s", pp)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 
-	fd, err := os.Open(pp)
-	if err == syscall.ENOENT {
-		log.Error(err.Error())
+	recursive := info.IsDir() && strings.ToLower(r.Header.Get("Depth")) == "infinity"
+
+	e := &journalEntry{}
+	e.Op = journalOpRm
+	e.Path = p
+
+	err = s.journaled(ctx, e, func() error {
+		if s.p.trash {
+			if info.IsDir() && !recursive {
+				infos, err := s.storage.ReadDir(p)
+				if err != nil {
+					return err
+				}
+				if len(infos) > 0 {
+					return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+				}
+			}
+			return s.moveToTrash(ctx, p, info)
+		}
+		if recursive {
+			return s.removeAll(ctx, p)
+		}
+		versions := s.getTreeVersionsDirs(ctx, p)
+		if err := s.storage.Remove(p); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			s.quota.release(authlib.MustFromContext(ctx), info.Size())
+		}
+		s.removeVersionsDirs(ctx, versions)
+		return nil
+	})
+
+	if isNotEmpty(err) {
+		log.Errorf("%s is a directory that is not empty", p)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("removed %s", p)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// move renames the path found in ctx to the path in the Destination header.
+// If the destination exists it is replaced unless the request carries
+// the Overwrite: F header.
+func (s *server) move(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+	src := lib.MustFromContext(ctx)
+
+	dst, err := getDestinationFromReq(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if !s.canWrite(ctx, dst) {
+		log.Warnf("%s cannot move to %s", *idt, dst)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		log.Errorf("cannot move %s into itself (%s)", src, dst)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	log.Infof("destination is %s", dst)
+
+	srcInfo, err := s.storage.Stat(src)
+	if os.IsNotExist(err) {
+		log.Error(err)
 		http.Error(w, "", http.StatusNotFound)
 		return
 	}
@@ -239,55 +935,342 @@ func (s *server) download(ctx context.Context, w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	log.Infof("opened %s", pp)
+	if !s.isParentDir(ctx, dst) {
+		log.Errorf("parent of %s does not exist", dst)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
 
-	info, err := fd.Stat()
-	if err != nil {
+	e := &journalEntry{}
+	e.Op = journalOpMv
+	e.Path = src
+	e.Dst = dst
+
+	var exists bool
+	err = s.journaled(ctx, e, func() error {
+		// The destination is checked holding its lock.
+		dstInfo, err := s.storage.Stat(dst)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		exists = err == nil
+
+		if exists && !getOverwriteFromReq(r) {
+			return errPreconditionFailed
+		}
+
+		// Files are replaced atomically by the rename, but
+		// directories cannot be renamed over existing paths.
+		if exists && (srcInfo.IsDir() || dstInfo.IsDir()) {
+			if err := s.removeAll(ctx, dst); err != nil {
+				return err
+			}
+		} else if exists {
+			s.quota.release(idt, dstInfo.Size())
+		}
+		if err := s.storage.Rename(src, dst); err != nil {
+			return err
+		}
+		s.moveVersions(ctx, src, dst)
+		return nil
+	})
+
+	if err == errPreconditionFailed {
+		log.Errorf("%s already exists", dst)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("stated %s got size %d", pp, info.Size())
+	log.Infof("moved %s to %s", src, dst)
 
-	if info.IsDir() {
-		log.Errorf("%s is a directory", pp)
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// copy copies the path found in ctx to the path in the Destination header.
+// Directories are copied with their contents unless the request carries
+// the Depth: 0 header. If the destination exists it is replaced unless
+// the request carries the Overwrite: F header.
+//
+// Every created entry is saved into the propagator with Put. Cp is not
+// used because the propagator does not implement it yet, and Put also
+// saves the checksum computed while copying.
+func (s *server) copy(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+	src := lib.MustFromContext(ctx)
+
+	dst, err := getDestinationFromReq(r)
+	if err != nil {
+		log.Error(err)
 		http.Error(w, "", http.StatusBadRequest)
 		return
 	}
 
-	defer fd.Close()
+	if !s.canWrite(ctx, dst) {
+		log.Warnf("%s cannot copy to %s", *idt, dst)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		log.Errorf("cannot copy %s into itself (%s)", src, dst)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	log.Infof("destination is %s", dst)
+
+	srcInfo, err := s.storage.Stat(src)
+	if os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
 
-	_, err = io.Copy(w, fd)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("copied %s to res.body", pp)
+	if !s.isParentDir(ctx, dst) {
+		log.Errorf("parent of %s does not exist", dst)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	overwrite := getOverwriteFromReq(r)
+
+	// Files are replaced atomically by the commit, which checks the
+	// destination holding its lock, but directories cannot be copied
+	// over existing paths so they are removed first.
+	var exists bool
+	dstInfo, err := s.storage.Stat(dst)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && (srcInfo.IsDir() || dstInfo.IsDir()) {
+		e := &journalEntry{}
+		e.Op = journalOpRm
+		e.Path = dst
+
+		err = s.journaled(ctx, e, func() error {
+			// The destination is checked again holding its lock.
+			if _, err := s.storage.Stat(dst); err != nil {
+				return err
+			}
+
+			exists = true
+
+			if !overwrite {
+				return errPreconditionFailed
+			}
+
+			return s.removeAll(ctx, dst)
+		})
+
+		if err == errPreconditionFailed {
+			log.Errorf("%s already exists", dst)
+			http.Error(w, "", http.StatusPreconditionFailed)
+			return
+		}
+
+		if err != nil && err != errPropagationPending && !os.IsNotExist(err) {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if srcInfo.IsDir() {
+		err = s.copyDir(ctx, src, dst, r.Header.Get("Depth") != "0")
+	} else {
+		err = s.copyFile(ctx, src, dst, func(info os.FileInfo) bool {
+			exists = exists || info != nil
+			return info == nil || overwrite
+		})
+	}
+
+	// The destination exists, checked holding its lock, or was created
+	// by another request while copying.
+	if err == errPreconditionFailed || os.IsExist(err) {
+		log.Errorf("%s already exists", dst)
+		http.Error(w, "", http.StatusPreconditionFailed)
+		return
+	}
+
+	if err == errQuotaExceeded {
+		log.Error(err)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("copied %s to %s", src, dst)
+
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// mkcol creates the directory found in ctx.
+// The parent directory must exist.
+func (s *server) mkcol(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	p := lib.MustFromContext(ctx)
+
+	if r.ContentLength > 0 {
+		log.Error("MKCOL does not accept a body")
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	_, err := s.storage.Stat(p)
+	if err == nil {
+		log.Errorf("%s already exists", p)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.isParentDir(ctx, p) {
+		log.Errorf("parent of %s does not exist", p)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	err = s.mkdir(ctx, p)
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 
+	w.WriteHeader(http.StatusCreated)
 }
 
 func (s *server) authHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
 	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
 
+	if isPublicPath(getPathFromReq(r)) {
+		s.linkHandler(ctx, w, r, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			s.homeHandler(ctx, w, r, next)
+		})
+		return
+	}
+
+	if s.isPresignedReq(r) {
+		s.presignedHandler(ctx, w, r, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			s.homeHandler(ctx, w, r, next)
+		})
+		return
+	}
+
+	s.identityHandler(ctx, w, r, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		s.scopeHandler(ctx, w, r, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			s.homeHandler(ctx, w, r, next)
+		})
+	})
+}
+
+// identityHandler authenticates the request and saves the identity,
+// the token and its scope into ctx.
+func (s *server) identityHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+
 	log := MustFromLogContext(ctx)
 
-	idt, err := s.getIdentityFromReq(r)
+	idt, sc, err := s.getIdentityFromReq(r)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
 
+	if !sc.all || sc.prefix != "" {
+		log.Infof("%s authenticated with %s", *idt, sc)
+	}
+
+	ctx = authlib.NewContext(ctx, idt)
+	ctx = authlib.NewTokenContext(ctx, s.getTokenFromReq(r))
+	ctx = newScopeContext(ctx, sc)
+	next(ctx, w, r)
+}
+
+// homeHandler checks that the path of the request is under the home
+// directory of the identity found in ctx, or shared with it, and saves
+// the path into ctx.
+func (s *server) homeHandler(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	next func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
 	p := getPathFromReq(r) // already sanitized
 
 	if !isUnderHome(p, idt) {
-		// TODO use here share service
-		log.Warnf("%s cannot access %s", *idt, p)
-		http.Error(w, "", http.StatusForbidden)
-		return
+		if s.shares == nil || getOwnerPid(p) == "" {
+			log.Warnf("%s cannot access %s", *idt, p)
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+
+		grant, err := s.shares.getGrant(ctx, authlib.MustFromTokenContext(ctx), idt, p)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		if !isAllowed(grant, r.Method) {
+			log.Warnf("%s cannot access %s, granted %s", *idt, p, grant)
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+
+		owner := getOwnerIdentity(p, grant.OwnerIdp)
+		if owner == nil {
+			log.Errorf("the share service did not answer the idp of the owner of %s", p)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		log.Infof("%s accesses %s shared by %s, granted %s", *idt, p, *owner, grant)
+
+		// The request is served on behalf of the owner.
+		ctx = newRequesterContext(ctx, idt)
+		ctx = authlib.NewContext(ctx, owner)
+		idt = owner
 	}
 
 	if p == getHome(idt) {
@@ -297,9 +1280,7 @@ func (s *server) authHandler(ctx context.Context, w http.ResponseWriter, r *http
 
 	log.Infof("path is %s", p)
 
-	ctx = authlib.NewContext(ctx, idt)
 	ctx = lib.NewContext(ctx, p)
-	ctx = authlib.NewTokenContext(ctx, s.getTokenFromReq(r))
 	next(ctx, w, r)
 }
 
@@ -315,10 +1296,6 @@ func (s *server) tmpFile() (string, *os.File, error) {
 	return fn, file, nil
 }
 
-func (s *server) getPhysicalPath(p string) string {
-	return path.Join(s.p.dataDir, path.Clean(p))
-}
-
 func (s *server) getTokenFromReq(r *http.Request) string {
 
 	var token string
@@ -343,6 +1320,6 @@ func (s *server) getTokenFromReq(r *http.Request) string {
 	return token
 }
 
-func (s *server) getIdentityFromReq(r *http.Request) (*authlib.Identity, error) {
-	return authlib.ParseToken(s.getTokenFromReq(r), s.p.sharedSecret)
+func (s *server) getIdentityFromReq(r *http.Request) (*authlib.Identity, *tokenScope, error) {
+	return s.tokens.parse(s.getTokenFromReq(r))
 }
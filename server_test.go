@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	pb "github.com/clawio/service-localfs-data/proto/propagator"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret = "secret"
+	testHome   = "/local/users/o/ourense"
+
+	// testServiceToken is the token of the service sent to the propagator.
+	testServiceToken = "service-token"
+)
+
+// testProp is a propagator that records the operations it receives.
+type testProp struct {
+	mu     sync.Mutex
+	ops    []string
+	tokens []string
+	down   bool
+
+	// checksums are the checksums of the last Put of every path.
+	checksums map[string]string
+}
+
+func (tp *testProp) record(op, token string) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.down {
+		return fmt.Errorf("propagator is down")
+	}
+	tp.ops = append(tp.ops, op)
+	tp.tokens = append(tp.tokens, token)
+	return nil
+}
+
+func (tp *testProp) Put(ctx context.Context, in *pb.PutReq) (*pb.Void, error) {
+	if err := tp.record("put "+in.Path, in.AccessToken); err != nil {
+		return nil, err
+	}
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.checksums[in.Path] = in.Checksum
+	return &pb.Void{}, nil
+}
+
+func (tp *testProp) Get(ctx context.Context, in *pb.GetReq) (*pb.Record, error) {
+	if err := tp.record("get "+in.Path, in.AccessToken); err != nil {
+		return nil, err
+	}
+	return &pb.Record{Path: in.Path, Checksum: tp.getChecksum(in.Path)}, nil
+}
+
+func (tp *testProp) Mv(ctx context.Context, in *pb.MvReq) (*pb.Void, error) {
+	return &pb.Void{}, tp.record("mv "+in.Src+" "+in.Dst, in.AccessToken)
+}
+
+func (tp *testProp) Rm(ctx context.Context, in *pb.RmReq) (*pb.Void, error) {
+	return &pb.Void{}, tp.record("rm "+in.Path, in.AccessToken)
+}
+
+func (tp *testProp) getOps() []string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]string{}, tp.ops...)
+}
+
+func (tp *testProp) getTokens() []string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]string{}, tp.tokens...)
+}
+
+func (tp *testProp) getChecksum(p string) string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.checksums[p]
+}
+
+func (tp *testProp) setDown(down bool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.down = down
+}
+
+// testEnv is a server with the memory backend and a test propagator.
+type testEnv struct {
+	t    *testing.T
+	s    *server
+	prop *testProp
+	dir  string
+	grpc *grpc.Server
+}
+
+// newTestEnv returns a server with the memory backend and the homes of
+// ourense and bob. mod can change the params before the server is created.
+func newTestEnv(t *testing.T, mod func(p *newServerParams)) *testEnv {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEnv{}
+	te.t = t
+	te.dir = dir
+	te.prop = &testProp{checksums: map[string]string{}}
+	te.grpc = grpc.NewServer()
+	pb.RegisterPropServer(te.grpc, te.prop)
+	go te.grpc.Serve(lis)
+
+	svcTokenFile := dir + "/service.token"
+	if err := ioutil.WriteFile(svcTokenFile, []byte(testServiceToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &newServerParams{}
+	p.dataDir = dir + "/data"
+	p.tmpDir = dir
+	p.backend = memoryBackend
+	p.prop = lis.Addr().String()
+	p.jwtAlgs = []string{"HS256"}
+	p.sharedSecret = testSecret
+	p.svcTokenFile = svcTokenFile
+	if mod != nil {
+		mod(p)
+	}
+
+	s, err := newServer(p)
+	if err != nil {
+		te.close()
+		t.Fatal(err)
+	}
+	te.s = s
+
+	for _, home := range []string{testHome, "/local/users/b/bob"} {
+		if err := storageMkdirAll(s.storage, home); err != nil {
+			te.close()
+			t.Fatal(err)
+		}
+	}
+
+	return te
+}
+
+func (te *testEnv) close() {
+	te.grpc.Stop()
+	os.RemoveAll(te.dir)
+}
+
+// do sends a request with token, if any, and returns the response.
+func (te *testEnv) do(method, url, token, body string, headers map[string]string) *httptest.ResponseRecorder {
+
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+
+	w := httptest.NewRecorder()
+	te.s.ServeHTTPC(context.Background(), w, r)
+	return w
+}
+
+// expect sends a request and fails if the status is not status.
+func (te *testEnv) expect(status int, method, url, token, body string, headers map[string]string) *httptest.ResponseRecorder {
+	w := te.do(method, url, token, body, headers)
+	if w.Code != status {
+		te.t.Fatalf("%s %s: got status %d, want %d", method, url, w.Code, status)
+	}
+	return w
+}
+
+// newTestToken returns a token signed with the shared secret with the
+// claims of the identity of pid and the extra claims.
+func newTestToken(pid string, extra map[string]interface{}) string {
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["pid"] = pid
+	token.Claims["idp"] = "local"
+	token.Claims["display_name"] = pid
+	token.Claims["email"] = pid + "@example.org"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	for name, value := range extra {
+		if value == nil {
+			delete(token.Claims, name)
+			continue
+		}
+		token.Claims[name] = value
+	}
+
+	t, err := token.SignedString([]byte(testSecret))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestUploadAndDownload(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+
+	w := te.expect(http.StatusCreated, "PUT", testHome+"/a.txt", tk, "hello", nil)
+	if w.Header().Get("ETag") == "" {
+		t.Error("upload without ETag")
+	}
+
+	w = te.expect(http.StatusOK, "GET", testHome+"/a.txt", tk, "", nil)
+	if w.Body.String() != "hello" {
+		t.Errorf("got %q, want %q", w.Body.String(), "hello")
+	}
+
+	if ops := te.prop.getOps(); len(ops) != 1 || ops[0] != "put "+testHome+"/a.txt" {
+		t.Errorf("got propagations %v", ops)
+	}
+
+	te.expect(http.StatusConflict, "PUT", testHome+"/missing/a.txt", tk, "hello", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/missing/a.txt?create_parents=true", tk, "hello", nil)
+
+	te.expect(http.StatusForbidden, "GET", testHome+"/a.txt", newTestToken("bob", nil), "", nil)
+	te.expect(http.StatusUnauthorized, "GET", testHome+"/a.txt", "", "", nil)
+}
+
+func TestUploadPreconditions(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	te.expect(http.StatusPreconditionFailed, "PUT", p, tk, "v1", map[string]string{"If-Match": "*"})
+	w := te.expect(http.StatusCreated, "PUT", p, tk, "v1", map[string]string{"If-None-Match": "*"})
+	etag := w.Header().Get("ETag")
+
+	te.expect(http.StatusPreconditionFailed, "PUT", p, tk, "v2", map[string]string{"If-None-Match": "*"})
+	te.expect(http.StatusPreconditionFailed, "PUT", p, tk, "v2", map[string]string{"If-None-Match": "W/" + etag})
+
+	// If-Match uses the strong comparison.
+	te.expect(http.StatusPreconditionFailed, "PUT", p, tk, "v2", map[string]string{"If-Match": "W/" + etag})
+	te.expect(http.StatusCreated, "PUT", p, tk, "v2", map[string]string{"If-Match": `"other", ` + etag})
+	te.expect(http.StatusPreconditionFailed, "PUT", p, tk, "v3", map[string]string{"If-Match": etag})
+
+	te.expectNoTmpFiles()
+}
+
+func TestConcurrentConditionalUploads(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	const n = 10
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			codes <- te.do("PUT", p, tk, "data", map[string]string{"If-None-Match": "*"}).Code
+		}()
+	}
+
+	created := 0
+	for i := 0; i < n; i++ {
+		if <-codes == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d uploads created the file, want 1", created)
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+	w := te.expect(http.StatusCreated, "PUT", p, tk, "hello world", nil)
+	etag := w.Header().Get("ETag")
+
+	w = te.expect(http.StatusPartialContent, "GET", p, tk, "", map[string]string{"Range": "bytes=6-"})
+	if w.Body.String() != "world" {
+		t.Errorf("got %q, want %q", w.Body.String(), "world")
+	}
+
+	w = te.expect(http.StatusPartialContent, "GET", p, tk, "", map[string]string{"Range": "bytes=0-0,10-10"})
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(data))
+	}
+	if strings.Join(parts, ",") != "h,d" {
+		t.Errorf("got parts %v, want h and d", parts)
+	}
+
+	te.expect(http.StatusRequestedRangeNotSatisfiable, "GET", p, tk, "", map[string]string{"Range": "bytes=20-30"})
+
+	// Ranges are ignored if the file changed.
+	w = te.expect(http.StatusOK, "GET", p, tk, "", map[string]string{"Range": "bytes=6-", "If-Range": `"other"`})
+	if w.Body.String() != "hello world" {
+		t.Errorf("got %q, want the whole file", w.Body.String())
+	}
+	te.expect(http.StatusPartialContent, "GET", p, tk, "", map[string]string{"Range": "bytes=6-", "If-Range": etag})
+
+	te.expect(http.StatusNotModified, "GET", p, tk, "", map[string]string{"If-None-Match": etag})
+	te.expect(http.StatusPreconditionFailed, "GET", p, tk, "", map[string]string{"If-Match": `"other"`})
+}
+
+func TestQuota(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.quota = 10
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+
+	te.expect(http.StatusCreated, "PUT", testHome+"/a", tk, "12345678", nil)
+	te.expect(http.StatusInsufficientStorage, "PUT", testHome+"/b", tk, "123", nil)
+
+	// The bytes of the replaced file are freed.
+	te.expect(http.StatusCreated, "PUT", testHome+"/a", tk, "1234567890", nil)
+
+	te.expect(http.StatusNoContent, "DELETE", testHome+"/a", tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/b", tk, "1234", nil)
+
+	// Copies count toward the quota.
+	te.expect(http.StatusCreated, "COPY", testHome+"/b", tk, "", map[string]string{"Destination": testHome + "/c"})
+	te.expect(http.StatusInsufficientStorage, "COPY", testHome+"/b", tk, "", map[string]string{"Destination": testHome + "/d"})
+
+	// The quota of every user is kept apart.
+	te.expect(http.StatusCreated, "PUT", "/local/users/b/bob/a", newTestToken("bob", nil), "1234567890", nil)
+}
+
+func TestStorageWrappers(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		writeTestKeyFile(t, p.tmpDir+"/keys.json")
+		p.keyFile = p.tmpDir + "/keys.json"
+		p.compress = true
+		p.dedup = true
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	data := strings.Repeat("compressible contents ", 1000)
+
+	te.expect(http.StatusCreated, "PUT", testHome+"/a", tk, data, nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/b", tk, data, nil)
+
+	for _, name := range []string{"a", "b"} {
+		w := te.expect(http.StatusOK, "GET", testHome+"/"+name, tk, "", nil)
+		if w.Body.String() != data {
+			t.Errorf("%s: got %d bytes, want the %d bytes uploaded", name, w.Body.Len(), len(data))
+		}
+	}
+
+	w := te.expect(http.StatusPartialContent, "GET", testHome+"/a", tk, "", map[string]string{"Range": "bytes=22-43"})
+	if w.Body.String() != "compressible contents " {
+		t.Errorf("got %q", w.Body.String())
+	}
+
+	// The contents of the users are not saved in clear.
+	m := te.s.storage.(*compressStorage).storage.(*cryptStorage).storage.(*dedupStorage).storage.(*memoryStorage)
+	for p, f := range m.files {
+		if bytes.Contains(f.data, []byte("compressible")) {
+			t.Errorf("%s is saved in clear", p)
+		}
+	}
+	if len(getBlobs(m)) == 0 {
+		t.Error("contents not saved as blobs")
+	}
+}
+
+func TestMoveAndCopy(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	a, b, c := testHome+"/a", testHome+"/b", testHome+"/c"
+
+	te.expect(http.StatusCreated, "PUT", a, tk, "a", nil)
+	te.expect(http.StatusCreated, "PUT", b, tk, "b", nil)
+
+	te.expect(http.StatusPreconditionFailed, "MOVE", a, tk, "", map[string]string{"Destination": b, "Overwrite": "F"})
+	te.expect(http.StatusCreated, "COPY", a, tk, "", map[string]string{"Destination": c})
+	te.expect(http.StatusNoContent, "MOVE", a, tk, "", map[string]string{"Destination": b})
+
+	te.expect(http.StatusNotFound, "GET", a, tk, "", nil)
+	for _, p := range []string{b, c} {
+		if w := te.expect(http.StatusOK, "GET", p, tk, "", nil); w.Body.String() != "a" {
+			t.Errorf("%s: got %q, want %q", p, w.Body.String(), "a")
+		}
+	}
+
+	// Nothing can be moved out of the home.
+	te.expect(http.StatusForbidden, "MOVE", b, tk, "", map[string]string{"Destination": "/local/users/b/bob/b"})
+
+	want := []string{"put " + a, "put " + b, "put " + c, "mv " + a + " " + b}
+	if ops := te.prop.getOps(); strings.Join(ops, ",") != strings.Join(want, ",") {
+		t.Errorf("got propagations %v, want %v", ops, want)
+	}
+}
+
+// expectNoTmpFiles fails if there are tmp files left in the tmp dir of te.
+func (te *testEnv) expectNoTmpFiles() {
+	files, err := ioutil.ReadDir(te.dir)
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), serviceID) {
+			te.t.Errorf("tmp file %s left behind", f.Name())
+		}
+	}
+}
+
+func TestCopyOverwrite(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	a, b, d := testHome+"/a", testHome+"/b", testHome+"/d"
+
+	te.expect(http.StatusCreated, "PUT", a, tk, "a", nil)
+	te.expect(http.StatusCreated, "PUT", b, tk, "b", nil)
+	te.expect(http.StatusCreated, "MKCOL", d, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", d+"/x", tk, "x", nil)
+
+	// Nothing is replaced with Overwrite: F.
+	te.expect(http.StatusPreconditionFailed, "COPY", a, tk, "", map[string]string{"Destination": b, "Overwrite": "F"})
+	te.expect(http.StatusPreconditionFailed, "COPY", a, tk, "", map[string]string{"Destination": d, "Overwrite": "F"})
+	te.expect(http.StatusPreconditionFailed, "COPY", d, tk, "", map[string]string{"Destination": a, "Overwrite": "F"})
+	if w := te.expect(http.StatusOK, "GET", b, tk, "", nil); w.Body.String() != "b" {
+		t.Errorf("got %q, want %q", w.Body.String(), "b")
+	}
+	te.expect(http.StatusOK, "GET", d+"/x", tk, "", nil)
+	te.expectNoTmpFiles()
+
+	te.expect(http.StatusNoContent, "COPY", a, tk, "", map[string]string{"Destination": b})
+	if w := te.expect(http.StatusOK, "GET", b, tk, "", nil); w.Body.String() != "a" {
+		t.Errorf("got %q, want %q", w.Body.String(), "a")
+	}
+
+	// Directories replace files and files replace directories.
+	te.expect(http.StatusNoContent, "COPY", d, tk, "", map[string]string{"Destination": b})
+	te.expect(http.StatusOK, "GET", b+"/x", tk, "", nil)
+	te.expect(http.StatusNoContent, "COPY", a, tk, "", map[string]string{"Destination": d})
+	if w := te.expect(http.StatusOK, "GET", d, tk, "", nil); w.Body.String() != "a" {
+		t.Errorf("got %q, want %q", w.Body.String(), "a")
+	}
+}
+
+func TestConcurrentCopies(t *testing.T) {
+
+	te := newTestEnv(t, nil)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/a", tk, "a", nil)
+
+	const n = 10
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			codes <- te.do("COPY", testHome+"/a", tk, "", map[string]string{
+				"Destination": testHome + "/b",
+				"Overwrite":   "F",
+			}).Code
+		}()
+	}
+
+	created := 0
+	for i := 0; i < n; i++ {
+		switch code := <-codes; code {
+		case http.StatusCreated:
+			created++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("got status %d", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d copies created the destination, want 1", created)
+	}
+	te.expectNoTmpFiles()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-data/proto/share"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths outside the home of the user are resolved with the share service,
+// which answers the access the user has been granted on them.
+// GET, HEAD and COPY requests need read access to the path of the request
+// and the rest need write access. The destination of COPY and MOVE
+// requests needs write access.
+//
+// Requests on shared paths are served on behalf of the owner of the home
+// they belong to, whose idp is answered by the share service along with
+// the grant, so the quota, the versions and the trash of the owner
+// are used. Moves and copies are limited to the home of the owner.
+//
+// The decisions of the share service are cached for a short time. The
+// expired ones are removed periodically and, when the cache is full, a
+// random decision is dropped to make room for the new one.
+
+const (
+	// shareCacheMaxEntries is the maximum number of cached decisions.
+	shareCacheMaxEntries = 10000
+
+	// shareCacheSweepInterval is how often the expired decisions
+	// are removed.
+	shareCacheSweepInterval = time.Minute
+)
+
+type shareResolver struct {
+	addr string
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedGrant
+}
+
+type cachedGrant struct {
+	grant   *pb.Grant
+	expires time.Time
+}
+
+func newShareResolver(addr string, ttl time.Duration) *shareResolver {
+	r := &shareResolver{}
+	r.addr = addr
+	r.ttl = ttl
+	r.cache = map[string]*cachedGrant{}
+	return r
+}
+
+// getGrant returns the access granted to idt, authenticated with token, on p.
+func (r *shareResolver) getGrant(ctx context.Context, token string, idt *authlib.Identity,
+	p string) (*pb.Grant, error) {
+
+	cacheKey := idt.Idp + "/" + idt.Pid + ":" + p
+
+	r.mu.Lock()
+	c, ok := r.cache[cacheKey]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(c.expires) {
+		return c.grant, nil
+	}
+
+	grant, err := r.lookup(ctx, token, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ttl <= 0 {
+		return grant, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cache[cacheKey]; !ok && len(r.cache) >= shareCacheMaxEntries {
+		// The iteration order of maps is random.
+		for k := range r.cache {
+			delete(r.cache, k)
+			break
+		}
+	}
+
+	r.cache[cacheKey] = &cachedGrant{grant, time.Now().Add(r.ttl)}
+	return grant, nil
+}
+
+// expireGrants removes the expired decisions from the cache forever.
+func (r *shareResolver) expireGrants() {
+
+	ticker := time.NewTicker(shareCacheSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.removeExpiredGrants()
+	}
+}
+
+func (r *shareResolver) removeExpiredGrants() {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range r.cache {
+		if !now.Before(c.expires) {
+			delete(r.cache, k)
+		}
+	}
+}
+
+func (r *shareResolver) lookup(ctx context.Context, token, p string) (*pb.Grant, error) {
+
+	con, err := grpc.Dial(r.addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	client := pb.NewShareClient(con)
+
+	ctx, cancel := context.WithTimeout(ctx, propagatorTimeout)
+	defer cancel()
+
+	in := &pb.LookupReq{}
+	in.AccessToken = token
+	in.Path = p
+
+	return client.Lookup(ctx, in)
+}
+
+// isAllowed reports if grant allows requests with method on the path
+// of the request.
+func isAllowed(grant *pb.Grant, method string) bool {
+	switch strings.ToUpper(method) {
+	case "GET", "HEAD", "COPY":
+		return grant.Read || grant.Write
+	default:
+		return grant.Write
+	}
+}
+
+// getOwnerPid returns the pid of the owner of the home p belongs to or
+// "" if p is not inside a home.
+func getOwnerPid(p string) string {
+
+	if !strings.HasPrefix(p, "/local/users/") {
+		return ""
+	}
+
+	pid := getOwner(p)
+	if pid == "" {
+		return ""
+	}
+
+	owner := &authlib.Identity{Pid: pid}
+	if home := getHome(owner); p == home || !isUnderHome(p, owner) {
+		return ""
+	}
+
+	return pid
+}
+
+// getOwnerIdentity returns the identity of the owner of the home p
+// belongs to, authenticated by idp, or nil if p is not inside a home.
+// The layout of the homes does not keep the idp, so it must come from
+// the share service, the link or the pre-signed URL that gives access
+// to p. It returns nil as well if idp is empty.
+func getOwnerIdentity(p, idp string) *authlib.Identity {
+
+	pid := getOwnerPid(p)
+	if pid == "" || idp == "" {
+		return nil
+	}
+
+	return &authlib.Identity{Pid: pid, Idp: idp}
+}
+
+// requesterKey is the context key for the identity that requested access
+// to a shared path.
+const requesterKey key = 1
+
+// newRequesterContext returns a new Context carrying the identity that
+// requested access to a shared path.
+func newRequesterContext(ctx context.Context, idt *authlib.Identity) context.Context {
+	return context.WithValue(ctx, requesterKey, idt)
+}
+
+// fromRequesterContext returns the identity that requested access to a
+// shared path. It reports false if the path was not shared.
+func fromRequesterContext(ctx context.Context) (*authlib.Identity, bool) {
+	idt, ok := ctx.Value(requesterKey).(*authlib.Identity)
+	return idt, ok
+}
+
+// canWrite reports if dst can be written by the request found in ctx.
+// dst must be below the home of the identity found in ctx and allowed
+// by the scope of the token and, for shared paths, the requester must
+// have write access to it.
+func (s *server) canWrite(ctx context.Context, dst string) bool {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	if !isUnderHome(dst, idt) || dst == getHome(idt) {
+		return false
+	}
+
+	if err := checkScope(ctx, "PUT", dst); err != nil {
+		log.Warn(err)
+		return false
+	}
+
+	requester, ok := fromRequesterContext(ctx)
+	if !ok {
+		return true
+	}
+
+	grant, err := s.shares.getGrant(ctx, authlib.MustFromTokenContext(ctx), requester, path.Clean(dst))
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	return grant.Write
+}
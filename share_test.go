@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-data/proto/share"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testQuotas gives 10 bytes to ourense authenticated by the corp idp.
+const testQuotas = `{"corp/ourense": 10}`
+
+// serveTestShares serves grants with a share stand-in. It returns the
+// address of the server and the function stopping it.
+func serveTestShares(t *testing.T, grants string) (string, func()) {
+
+	grantsFile := newTestTmpFile(t, grants)
+	defer os.Remove(grantsFile)
+
+	ss, err := newShareStandIn(grantsFile, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterShareServer(srv, ss)
+	go srv.Serve(lis)
+
+	return lis.Addr().String(), srv.Stop
+}
+
+// newShareTestEnv returns a server resolving shared paths with a share
+// stand-in serving grants.
+func newShareTestEnv(t *testing.T, grants string, mod func(p *newServerParams)) (*testEnv, func()) {
+
+	addr, stop := serveTestShares(t, grants)
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.share = addr
+		p.shareCache = time.Minute
+		if mod != nil {
+			mod(p)
+		}
+	})
+
+	return te, func() {
+		te.close()
+		stop()
+	}
+}
+
+func TestShares(t *testing.T) {
+
+	quotaFile := newTestTmpFile(t, testQuotas)
+	defer os.Remove(quotaFile)
+
+	te, closeEnv := newShareTestEnv(t, `[
+		{"path": "/local/users/o/ourense/team", "grantee": "local/bob", "write": true, "owner_idp": "corp"},
+		{"path": "/local/users/o/ourense/docs", "grantee": "bob", "owner_idp": "corp"},
+		{"path": "/local/users/o/ourense/noidp", "grantee": "bob", "write": true}
+	]`, func(p *newServerParams) {
+		p.quotaFile = quotaFile
+	})
+	defer closeEnv()
+
+	owner := newTestToken("ourense", map[string]interface{}{"idp": "corp"})
+	bob := newTestToken("bob", nil)
+
+	for _, dir := range []string{"team", "docs", "noidp", "other"} {
+		te.expect(http.StatusCreated, "MKCOL", testHome+"/"+dir, owner, "", nil)
+	}
+	te.expect(http.StatusCreated, "PUT", testHome+"/docs/a.txt", owner, "hello", nil)
+
+	// Read-only grants.
+	w := te.expect(http.StatusOK, "GET", testHome+"/docs/a.txt", bob, "", nil)
+	if w.Body.String() != "hello" {
+		t.Errorf("got %q, want %q", w.Body.String(), "hello")
+	}
+	te.expect(http.StatusForbidden, "PUT", testHome+"/docs/b.txt", bob, "hello", nil)
+
+	// Writes are charged to the quota of the owner, found by the idp
+	// answered with the grant.
+	te.expect(http.StatusCreated, "PUT", testHome+"/team/a.txt", bob, "hello", nil)
+	te.expect(http.StatusInsufficientStorage, "PUT", testHome+"/team/b.txt", bob, "x", nil)
+
+	// The destination needs write access too.
+	te.expect(http.StatusForbidden, "COPY", testHome+"/docs/a.txt", bob, "",
+		map[string]string{"Destination": testHome + "/docs/b.txt"})
+
+	// Paths without grant or without the idp of the owner are refused.
+	te.expect(http.StatusForbidden, "GET", testHome+"/other", bob, "", nil)
+	te.expect(http.StatusInternalServerError, "GET", testHome+"/noidp", bob, "", nil)
+}
+
+func TestShareCache(t *testing.T) {
+
+	addr, stop := serveTestShares(t, `[{"path": "/local/users/o/ourense", "grantee": "bob", "owner_idp": "local"}]`)
+
+	r := newShareResolver(addr, time.Minute)
+	bob := &authlib.Identity{Pid: "bob", Idp: "local"}
+	tk := newTestToken("bob", nil)
+	ctx := context.Background()
+
+	// The cache is bounded.
+	for i := 0; i < shareCacheMaxEntries; i++ {
+		r.cache[fmt.Sprintf("local/bob:/%d", i)] = &cachedGrant{&pb.Grant{}, time.Now().Add(time.Minute)}
+	}
+	grant, err := r.getGrant(ctx, tk, bob, testHome+"/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !grant.Read || grant.OwnerIdp != "local" {
+		t.Errorf("got grant %s", grant)
+	}
+	if len(r.cache) != shareCacheMaxEntries {
+		t.Errorf("%d cached decisions, want %d", len(r.cache), shareCacheMaxEntries)
+	}
+
+	// The decisions are answered from the cache.
+	stop()
+	if _, err := r.getGrant(ctx, tk, bob, testHome+"/a"); err != nil {
+		t.Error(err)
+	}
+
+	// And removed once expired.
+	for _, c := range r.cache {
+		c.expires = time.Now()
+	}
+	r.removeExpiredGrants()
+	if len(r.cache) != 0 {
+		t.Errorf("%d cached decisions after expiring them", len(r.cache))
+	}
+}
+
+func TestLinksAndPresignedURLsKeepIdp(t *testing.T) {
+
+	quotaFile := newTestTmpFile(t, testQuotas)
+	defer os.Remove(quotaFile)
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.quotaFile = quotaFile
+		p.links = true
+		p.presignMaxAge = time.Hour
+	})
+	defer te.close()
+
+	owner := newTestToken("ourense", map[string]interface{}{"idp": "corp"})
+	dir := testHome + "/inbox"
+	te.expect(http.StatusCreated, "MKCOL", dir, owner, "", nil)
+
+	// Both are charged to the quota of corp/ourense.
+	l := te.createLink(owner, dir, url.Values{"mode": {linkModeUpload}}, "")
+	te.expect(http.StatusCreated, "PUT", l.URL+"/a.txt", "", "hello", nil)
+
+	u := te.presign(owner, "PUT", testHome+"/b.txt", nil)
+	te.expect(http.StatusCreated, "PUT", u, "", "hello", nil)
+
+	u = te.presign(owner, "PUT", testHome+"/c.txt", nil)
+	te.expect(http.StatusInsufficientStorage, "PUT", u, "", "x", nil)
+
+	data, err := ioutil.ReadFile(te.dir + "/" + linksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"idp":"corp"`) {
+		t.Errorf("link saved without the idp: %s", data)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	authlib "github.com/clawio/service-auth/lib"
+	pb "github.com/clawio/service-localfs-data/proto/share"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+)
+
+// shareStandIn is a share service that answers with the grants of a
+// local file. It stands in for the real share service in tests and
+// development setups and it is started with the share-standin argument.
+//
+// The grants file is a JSON array like:
+//
+// [{"path": "/local/users/o/ourense/team", "grantee": "local/bob",
+// "write": true, "owner_idp": "local"}]
+//
+// The grantee is given as <idp>/<pid> or <pid> and owner_idp is the idp
+// of the owner of the home the path belongs to. A grant applies to the
+// path and to everything below it and the longest matching path wins.
+type shareStandIn struct {
+	sharedSecret string
+	grants       []*standInGrant
+}
+
+type standInGrant struct {
+	Path     string `json:"path"`
+	Grantee  string `json:"grantee"`
+	Write    bool   `json:"write"`
+	OwnerIdp string `json:"owner_idp"`
+}
+
+func newShareStandIn(grantsFile, sharedSecret string) (*shareStandIn, error) {
+
+	data, err := ioutil.ReadFile(grantsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &shareStandIn{}
+	ss.sharedSecret = sharedSecret
+	if err := json.Unmarshal(data, &ss.grants); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func (ss *shareStandIn) Lookup(ctx context.Context, in *pb.LookupReq) (*pb.Grant, error) {
+
+	idt, err := authlib.ParseToken(in.AccessToken, ss.sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	p := path.Clean(in.Path)
+
+	var match *standInGrant
+	for _, g := range ss.grants {
+		if g.Grantee != idt.Pid && g.Grantee != idt.Idp+"/"+idt.Pid {
+			continue
+		}
+		gp := path.Clean(g.Path)
+		if p != gp && !strings.HasPrefix(p, gp+"/") {
+			continue
+		}
+		if match == nil || len(gp) > len(path.Clean(match.Path)) {
+			match = g
+		}
+	}
+
+	grant := &pb.Grant{}
+	if match != nil {
+		grant.Read = true
+		grant.Write = match.Write
+		grant.OwnerIdp = match.OwnerIdp
+	}
+
+	return grant, nil
+}
+
+// serveShareStandIn serves the grants of grantsFile on addr.
+func serveShareStandIn(addr, grantsFile, sharedSecret string) error {
+
+	ss, err := newShareStandIn(grantsFile, sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterShareServer(srv, ss)
+	return srv.Serve(l)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+)
+
+const (
+	localBackend  = "local"
+	memoryBackend = "memory"
+)
+
+// storage is the interface implemented by the storage backends where the
+// data is saved. Paths are logical paths like /local/users/o/ourense/file.
+// Errors for paths that do not exist must satisfy os.IsNotExist.
+//
+// Uploads are always staged into local tmp files inside the tmp dir and
+// then committed into the storage.
+type storage interface {
+	// Open opens the file at p for reading.
+	Open(p string) (storageFile, error)
+
+	// Stat returns information about p.
+	Stat(p string) (os.FileInfo, error)
+
+	// ReadDir returns the entries of the directory p sorted by name.
+	ReadDir(p string) ([]os.FileInfo, error)
+
+	// Commit atomically replaces p with the contents of the local
+	// tmp file tmpFn. After a successful commit tmpFn no longer exists.
+	Commit(tmpFn, p string) error
+
+	// Mkdir creates the directory p. The parent must exist.
+	Mkdir(p string) error
+
+	// Remove removes p. Directories must be empty.
+	Remove(p string) error
+
+	// RemoveAll removes p and any children it contains.
+	RemoveAll(p string) error
+
+	// Rename atomically renames src to dst.
+	Rename(src, dst string) error
+
+	// GetAttrs returns the extended attributes of the file p.
+	GetAttrs(p string) (map[string]string, error)
+
+	// SetAttrs saves attrs as extended attributes of the file p.
+	// Other attributes of p are kept. The attributes of p are lost
+	// when it is replaced by Commit and follow it when it is renamed.
+	SetAttrs(p string, attrs map[string]string) error
+}
+
+// storageFile is a file opened for reading.
+type storageFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// checksumCommitter is implemented by the storage backends that make use
+// of the checksum computed while receiving the data.
+type checksumCommitter interface {
+	// CommitChecksum is like Commit, with checksums being the checksums
+	// of the contents of tmpFn. checksums can be empty.
+	CommitChecksum(tmpFn, p string, checksums []*checksum) error
+}
+
+// newStorage returns the storage backend configured in p.
+// If deduplication is enabled the backend is wrapped by a dedupStorage.
+func newStorage(p *newServerParams) (storage, error) {
+
+	var st storage
+	switch p.backend {
+	case localBackend, "":
+		st = newLocalStorage(p.dataDir)
+	case memoryBackend:
+		st = newMemoryStorage()
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", p.backend)
+	}
+
+	if p.dedup {
+		return newDedupStorage(st, p.tmpDir)
+	}
+
+	return st, nil
+}
+
+// isNotEmpty reports if err is the error returned when removing
+// a directory that is not empty.
+func isNotEmpty(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOTEMPTY || err == syscall.EEXIST
+}
+
+// storageMkdirAll creates the directory p in st along with any missing parents.
+// Unlike server.mkdirAll the directories are not saved into the propagator,
+// so it is meant for the internal areas of the storage.
+func storageMkdirAll(st storage, p string) error {
+
+	info, err := st.Stat(p)
+	if err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := storageMkdirAll(st, path.Dir(p)); err != nil {
+		return err
+	}
+
+	if err := st.Mkdir(p); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
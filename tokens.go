@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are validated with these rules:
+// - the alg of the token must be one of the allowed algorithms,
+// - tokens with a kid are verified with the key with that kid in the
+// JWKS file, which must be of the type of the alg,
+// - HS256 tokens without kid are verified with the shared secret,
+// - exp and nbf are checked allowing the clock skew and, if configured,
+// tokens without exp are rejected,
+// - the aud and iss claims must match the audience and the issuer
+// when they are configured.
+//
+// The JWKS file is read again when it changes, so keys can be rotated
+// by adding the new key, waiting for the tokens signed with the old
+// one to expire and removing it.
+
+const (
+	// jwksCheckInterval is the minimum time between checks for
+	// changes of the JWKS file.
+	jwksCheckInterval = 10 * time.Second
+)
+
+// jwtAlgs are the algorithms that can be allowed.
+var jwtAlgs = map[string]bool{
+	"HS256": true,
+	"RS256": true,
+	"ES256": true,
+}
+
+// getJWTAlgs parses a comma separated list of algorithms.
+func getJWTAlgs(v string) ([]string, error) {
+
+	algs := []string{}
+	for _, alg := range strings.Split(v, ",") {
+		alg = strings.ToUpper(strings.TrimSpace(alg))
+		if alg == "" {
+			continue
+		}
+		if !jwtAlgs[alg] {
+			return nil, fmt.Errorf("unsupported token algorithm %q", alg)
+		}
+		algs = append(algs, alg)
+	}
+
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("no token algorithm allowed")
+	}
+
+	return algs, nil
+}
+
+// jwk is a key of a JWKS file. Only the fields of oct, RSA and EC keys
+// are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []*jwk `json:"keys"`
+}
+
+// verificationKey is a key of the JWKS file ready to verify tokens.
+type verificationKey struct {
+	alg string
+	key interface{}
+}
+
+type tokenValidator struct {
+	secret   string
+	algs     []string
+	audience string
+	issuer   string
+	leeway   time.Duration
+	// requireExp rejects the tokens without the exp claim.
+	requireExp bool
+	jwksFile   string
+
+	mu        sync.Mutex
+	keys      map[string]*verificationKey
+	jwksMod   time.Time
+	jwksCheck time.Time
+}
+
+// newTokenValidator returns a validator with the keys of the JWKS file
+// of p, if any.
+func newTokenValidator(p *newServerParams) (*tokenValidator, error) {
+
+	v := &tokenValidator{}
+	v.secret = p.sharedSecret
+	v.algs = p.jwtAlgs
+	v.audience = p.jwtAudience
+	v.issuer = p.jwtIssuer
+	v.leeway = p.jwtLeeway
+	v.requireExp = p.jwtRequireExp
+	v.jwksFile = p.jwksFile
+	v.keys = map[string]*verificationKey{}
+
+	if v.jwksFile != "" {
+		if err := v.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// loadKeys reads the keys of the JWKS file if it changed since it was
+// last read. It must be called with the lock held.
+func (v *tokenValidator) loadKeys() error {
+
+	info, err := os.Stat(v.jwksFile)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(v.jwksMod) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(v.jwksFile)
+	if err != nil {
+		return err
+	}
+
+	set := &jwks{}
+	if err := json.Unmarshal(data, set); err != nil {
+		return err
+	}
+
+	keys := map[string]*verificationKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Kid == "" {
+			return fmt.Errorf("key without kid in %s", v.jwksFile)
+		}
+		vk, err := k.getVerificationKey()
+		if err != nil {
+			return fmt.Errorf("invalid key %q in %s: %s", k.Kid, v.jwksFile, err)
+		}
+		keys[k.Kid] = vk
+	}
+
+	v.keys = keys
+	v.jwksMod = info.ModTime()
+	return nil
+}
+
+// getKey returns the key with kid. The JWKS file is checked for changes
+// from time to time. If it cannot be read the last keys are used.
+func (v *tokenValidator) getKey(kid string) (*verificationKey, error) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.jwksFile == "" {
+		return nil, fmt.Errorf("no key for kid %q", kid)
+	}
+
+	if time.Since(v.jwksCheck) > jwksCheckInterval {
+		v.jwksCheck = time.Now()
+		if err := v.loadKeys(); err != nil {
+			log.Errorf("cannot reload %s: %s", v.jwksFile, err)
+		}
+	}
+
+	vk, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no key for kid %q", kid)
+	}
+
+	return vk, nil
+}
+
+// getVerificationKey returns the key of k and the algorithm it verifies.
+func (k *jwk) getVerificationKey() (*verificationKey, error) {
+
+	vk := &verificationKey{}
+
+	switch k.Kty {
+	case "oct":
+		secret, err := decodeJWKField(k.K)
+		if err != nil {
+			return nil, err
+		}
+		vk.alg = "HS256"
+		vk.key = secret
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		vk.alg = "RS256"
+		vk.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve := elliptic.P256()
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		vk.alg = "ES256"
+		vk.key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	if k.Alg != "" && k.Alg != vk.alg {
+		return nil, fmt.Errorf("unsupported algorithm %q for key type %q", k.Alg, k.Kty)
+	}
+
+	return vk, nil
+}
+
+func decodeJWKField(v string) ([]byte, error) {
+	if v == "" {
+		return nil, fmt.Errorf("missing key field")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+}
+
+func decodeJWKInt(v string) (*big.Int, error) {
+	b, err := decodeJWKField(v)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keyFunc returns the key to verify token.
+func (v *tokenValidator) keyFunc(token *jwt.Token) (interface{}, error) {
+
+	alg := token.Method.Alg()
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if alg == "HS256" && v.secret != "" {
+			return []byte(v.secret), nil
+		}
+		return nil, fmt.Errorf("missing kid for %s token", alg)
+	}
+
+	vk, err := v.getKey(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if vk.alg != alg {
+		return nil, fmt.Errorf("key %q cannot verify %s tokens", kid, alg)
+	}
+
+	return vk.key, nil
+}
+
+// parse validates t and returns the identity and the scope it carries.
+func (v *tokenValidator) parse(t string) (*authlib.Identity, *tokenScope, error) {
+
+	parser := &jwt.Parser{ValidMethods: v.algs}
+	token, err := parser.Parse(t, v.keyFunc)
+
+	// exp and nbf are checked below allowing the clock skew, so they
+	// are not errors if the rest of the token is valid.
+	if verr, ok := err.(*jwt.ValidationError); ok {
+		timeErrors := jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet
+		if verr.Errors&^timeErrors != 0 {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if err := v.checkClaims(token.Claims); err != nil {
+		return nil, nil, err
+	}
+
+	idt, err := getIdentityFromClaims(token.Claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, err := getScopeFromClaims(token.Claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return idt, sc, nil
+}
+
+// checkClaims checks the exp, nbf, aud and iss claims.
+func (v *tokenValidator) checkClaims(claims map[string]interface{}) error {
+
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && v.requireExp {
+		return fmt.Errorf("token without expiration time")
+	}
+	if ok && now.Add(-v.leeway).Unix() > int64(exp) {
+		return fmt.Errorf("token is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Unix() < int64(nbf) {
+		return fmt.Errorf("token is not valid yet")
+	}
+
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return fmt.Errorf("token is not for audience %q", v.audience)
+	}
+
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("token is not issued by %q", v.issuer)
+		}
+	}
+
+	return nil
+}
+
+// hasAudience reports if aud, a string or a list of strings, contains
+// audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a, ok := a.(string); ok && a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getIdentityFromClaims returns the identity of the claims of a token
+// issued by the auth service.
+func getIdentityFromClaims(claims map[string]interface{}) (*authlib.Identity, error) {
+
+	idt := &authlib.Identity{}
+
+	fields := map[string]*string{
+		"pid":          &idt.Pid,
+		"idp":          &idt.Idp,
+		"display_name": &idt.DisplayName,
+		"email":        &idt.Email,
+	}
+
+	for name, field := range fields {
+		v, ok := claims[name].(string)
+		if !ok {
+			return nil, fmt.Errorf("claim %s is not a string: %v", name, claims[name])
+		}
+		*field = v
+	}
+
+	if idt.Pid == "" {
+		return nil, fmt.Errorf("empty pid claim")
+	}
+
+	return idt, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	oct []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+
+	k := &testKeys{}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.rsa = rsaKey
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.ec = ecKey
+
+	k.oct = []byte("another secret")
+	return k
+}
+
+func encodeJWKInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// writeJWKS writes the public keys of k into fn. Keys whose kid is not
+// in kids are left out.
+func (k *testKeys) writeJWKS(t *testing.T, fn string, kids ...string) {
+
+	all := map[string]*jwk{
+		"rsa": {Kty: "RSA", Kid: "rsa", Use: "sig",
+			N: encodeJWKInt(k.rsa.N), E: encodeJWKInt(big.NewInt(int64(k.rsa.E)))},
+		"ec": {Kty: "EC", Kid: "ec", Crv: "P-256",
+			X: encodeJWKInt(k.ec.X), Y: encodeJWKInt(k.ec.Y)},
+		"oct": {Kty: "oct", Kid: "oct", Alg: "HS256",
+			K: base64.RawURLEncoding.EncodeToString(k.oct)},
+	}
+
+	set := &jwks{}
+	for _, kid := range kids {
+		set.Keys = append(set.Keys, all[kid])
+	}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns a token of ourense with the extra claims signed with the
+// key kid and method. An empty kid signs with the shared secret.
+func (k *testKeys) sign(t *testing.T, method jwt.SigningMethod, kid string, extra map[string]interface{}) string {
+
+	var key interface{} = []byte(testSecret)
+	switch kid {
+	case "rsa":
+		key = k.rsa
+	case "ec":
+		key = k.ec
+	case "oct":
+		key = k.oct
+	}
+
+	return signTestToken(t, method, kid, key, extra)
+}
+
+// signTestToken returns a token of ourense with the extra claims signed
+// with key and method and with kid in the header, if not empty.
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, extra map[string]interface{}) string {
+
+	token := jwt.New(method)
+	token.Claims["pid"] = "ourense"
+	token.Claims["idp"] = "local"
+	token.Claims["display_name"] = "Ourense"
+	token.Claims["email"] = "ourense@example.org"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	for name, value := range extra {
+		if value == nil {
+			delete(token.Claims, name)
+			continue
+		}
+		token.Claims[name] = value
+	}
+
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestValidator(t *testing.T, jwksFile string, mod func(p *newServerParams)) *tokenValidator {
+
+	p := &newServerParams{}
+	p.sharedSecret = testSecret
+	p.jwtAlgs = []string{"HS256", "RS256", "ES256"}
+	p.jwksFile = jwksFile
+	if mod != nil {
+		mod(p)
+	}
+
+	v, err := newTokenValidator(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestTokenValidatorKeys(t *testing.T) {
+
+	k := newTestKeys(t)
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := dir + "/jwks.json"
+	k.writeJWKS(t, fn, "rsa", "ec", "oct")
+
+	v := newTestValidator(t, fn, nil)
+
+	// alg none is never accepted.
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		strings.Split(k.sign(t, jwt.SigningMethodHS256, "", nil), ".")[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"shared secret", k.sign(t, jwt.SigningMethodHS256, "", nil), true},
+		{"rsa", k.sign(t, jwt.SigningMethodRS256, "rsa", nil), true},
+		{"ec", k.sign(t, jwt.SigningMethodES256, "ec", nil), true},
+		{"oct", k.sign(t, jwt.SigningMethodHS256, "oct", nil), true},
+		{"alg none", none, false},
+		{"rsa without kid", signTestToken(t, jwt.SigningMethodRS256, "", k.rsa, nil), false},
+		{"unknown kid", signTestToken(t, jwt.SigningMethodHS256, "other", k.oct, nil), false},
+		{"hs256 with rsa kid", signTestToken(t, jwt.SigningMethodHS256, "rsa", []byte("x"), nil), false},
+		{"bad signature", k.sign(t, jwt.SigningMethodHS256, "oct", nil) + "x", false},
+		{"missing pid", k.sign(t, jwt.SigningMethodHS256, "", map[string]interface{}{"pid": nil}), false},
+	}
+
+	for _, test := range tests {
+		idt, _, err := v.parse(test.token)
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.ok && err == nil && idt.Pid != "ourense" {
+			t.Errorf("%s: got pid %q", test.name, idt.Pid)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+
+	// Algorithms that are not allowed are rejected.
+	hsOnly := newTestValidator(t, fn, func(p *newServerParams) {
+		p.jwtAlgs = []string{"HS256"}
+	})
+	if _, _, err := hsOnly.parse(k.sign(t, jwt.SigningMethodRS256, "rsa", nil)); err == nil {
+		t.Error("RS256 token accepted with HS256 only")
+	}
+
+	// Removed keys stop working once the JWKS file is read again.
+	k.writeJWKS(t, fn, "ec")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fn, later, later)
+	v.jwksCheck = time.Time{}
+	if _, _, err := v.parse(k.sign(t, jwt.SigningMethodRS256, "rsa", nil)); err == nil {
+		t.Error("token of a removed key accepted")
+	}
+	if _, _, err := v.parse(k.sign(t, jwt.SigningMethodES256, "ec", nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenValidatorClaims(t *testing.T) {
+
+	v := newTestValidator(t, "", func(p *newServerParams) {
+		p.jwtAudience = "data"
+		p.jwtIssuer = "auth"
+		p.jwtLeeway = time.Minute
+	})
+
+	now := time.Now()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"aud": "data", "iss": "auth"}
+		for name, value := range extra {
+			c[name] = value
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{"valid", claims(nil), true},
+		{"missing exp", claims(map[string]interface{}{"exp": nil}), true},
+		{"audience list", claims(map[string]interface{}{"aud": []string{"other", "data"}}), true},
+		{"other audience", claims(map[string]interface{}{"aud": "other"}), false},
+		{"missing audience", claims(map[string]interface{}{"aud": nil}), false},
+		{"other issuer", claims(map[string]interface{}{"iss": "other"}), false},
+		{"expired in leeway", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), true},
+		{"expired", claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}), false},
+		{"not valid yet in leeway", claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}), true},
+		{"not valid yet", claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()}), false},
+	}
+
+	for _, test := range tests {
+		_, _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, "", []byte(testSecret), test.claims))
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+}
+
+func TestTokenValidatorRequireExp(t *testing.T) {
+
+	v := newTestValidator(t, "", func(p *newServerParams) {
+		p.jwtRequireExp = true
+	})
+
+	if _, _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, "", []byte(testSecret), nil)); err != nil {
+		t.Error(err)
+	}
+	noExp := map[string]interface{}{"exp": nil}
+	if _, _, err := v.parse(signTestToken(t, jwt.SigningMethodHS256, "", []byte(testSecret), noExp)); err == nil {
+		t.Error("token without exp accepted")
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the trash is enabled deleted files and directories are moved into
+// a per-home area outside the visible home layout instead of being removed:
+// /trash/<letter>/<pid>/<item id>/data keeps the deleted entry and
+// /trash/<letter>/<pid>/<item id>/info keeps its original path and
+// deletion time. The item id is the deletion time in nanoseconds.
+// Items in the trash do not count towards the quota of the user.
+//
+// GET /trash lists the items in the trash of the user.
+// POST /trash/<id> restores an item to its original path.
+// DELETE /trash/<id> purges an item.
+// DELETE /trash purges all the items.
+//
+// Items older than the retention period are purged in the background.
+
+const (
+	trashEndPoint = "/trash"
+	trashRoot     = "/trash"
+
+	trashDataFile = "data"
+	trashInfoFile = "info"
+
+	trashExpiryInterval = time.Hour
+)
+
+type trashItem struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Deleted int64  `json:"deleted"`
+	IsDir   bool   `json:"is_dir"`
+	Size    int64  `json:"size"`
+}
+
+// trash handles the requests to the trash endpoint.
+func (s *server) trash(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+
+	if err := checkHomeScope(ctx, r.Method); err != nil {
+		log.Warn(err)
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(getPathFromReq(r), trashEndPoint), "/")
+
+	if id != "" {
+		// The id is used to build paths, so it must be a number.
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			log.Errorf("invalid trash item id %q", id)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case strings.ToUpper(r.Method) == "GET" && id == "":
+		log.WithField("op", "list-trash").Info()
+		s.listTrash(ctx, w, r)
+	case strings.ToUpper(r.Method) == "POST" && id != "":
+		log.WithField("op", "restore-trash").Info()
+		s.restoreTrash(ctx, w, r, id)
+	case strings.ToUpper(r.Method) == "DELETE":
+		log.WithField("op", "purge-trash").Info()
+		s.purgeTrash(ctx, w, r, id)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) listTrash(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+
+	items, err := s.getTrashItems(authlib.MustFromContext(ctx))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		log.Error(err)
+	}
+}
+
+// restoreTrash moves an item back to its original path.
+func (s *server) restoreTrash(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+
+	log := MustFromLogContext(ctx)
+	idt := authlib.MustFromContext(ctx)
+
+	itemDir := path.Join(s.getTrashDir(idt), id)
+
+	item, err := s.getTrashItem(itemDir)
+	if os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	dataPath := path.Join(itemDir, trashDataFile)
+
+	size, err := getTreeSize(s.storage, dataPath)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	e := &journalEntry{}
+	e.Op = journalOpPut
+	e.Path = item.Path
+
+	// The checksum saved along with the file is saved into the propagator.
+	if !item.IsDir {
+		attrs := s.getAttrsOrEmpty(ctx, dataPath)
+		if len(attrs.checksums) > 0 {
+			e.Checksum = attrs.checksums[0].String()
+		}
+	}
+
+	err = s.journaled(ctx, e, func() error {
+		// The original path is checked holding its lock.
+		_, err := s.storage.Stat(item.Path)
+		if err == nil {
+			log.Errorf("cannot restore %s because it already exists", item.Path)
+			return errPreconditionFailed
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		if !s.isParentDir(ctx, item.Path) {
+			log.Errorf("cannot restore %s because its parent does not exist", item.Path)
+			return errPreconditionFailed
+		}
+
+		if err := s.quota.reserve(idt, size); err != nil {
+			return err
+		}
+
+		if err := s.storage.Rename(dataPath, item.Path); err != nil {
+			s.quota.release(idt, size)
+			return err
+		}
+
+		return nil
+	})
+
+	if err == errPreconditionFailed {
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	if err == errQuotaExceeded {
+		log.Error(err)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.storage.RemoveAll(itemDir); err != nil {
+		log.Error(err)
+	}
+
+	if item.IsDir {
+		if err := s.propagateTree(ctx, item.Path); err != nil {
+			log.Error(err)
+		}
+	}
+
+	log.Infof("restored trash item %s to %s", id, item.Path)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeTrash removes an item from the trash.
+// If id is empty all the items are removed.
+func (s *server) purgeTrash(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+
+	log := MustFromLogContext(ctx)
+
+	p := path.Join(s.getTrashDir(authlib.MustFromContext(ctx)), id)
+
+	if _, err := s.storage.Stat(p); err != nil {
+		if os.IsNotExist(err) && id == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.Error(err)
+		if os.IsNotExist(err) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.storage.RemoveAll(p); err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("purged %s", p)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moveToTrash moves p into the trash of the identity found in ctx
+// and frees the quota used by p.
+func (s *server) moveToTrash(ctx context.Context, p string, info os.FileInfo) error {
+
+	idt := authlib.MustFromContext(ctx)
+
+	size, err := getTreeSize(s.storage, p)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	item := &trashItem{}
+	item.ID = strconv.FormatInt(now.UnixNano(), 10)
+	item.Path = p
+	item.Deleted = now.Unix()
+	item.IsDir = info.IsDir()
+	item.Size = size
+
+	itemDir := path.Join(s.getTrashDir(idt), item.ID)
+	if err := storageMkdirAll(s.storage, itemDir); err != nil {
+		return err
+	}
+
+	tmpFn, tmpFile, err := s.tmpFile()
+	if err != nil {
+		return err
+	}
+
+	versions := s.getTreeVersionsDirs(ctx, p)
+
+	err = json.NewEncoder(tmpFile).Encode(item)
+	tmpFile.Close()
+	if err == nil {
+		err = s.storage.Commit(tmpFn, path.Join(itemDir, trashInfoFile))
+	}
+	if err == nil {
+		err = s.storage.Rename(p, path.Join(itemDir, trashDataFile))
+	}
+	if err != nil {
+		os.Remove(tmpFn)
+		s.storage.RemoveAll(itemDir)
+		return err
+	}
+
+	s.quota.release(idt, size)
+
+	// The versions are not restored along with the item.
+	s.removeVersionsDirs(ctx, versions)
+
+	MustFromLogContext(ctx).Infof("moved %s to trash item %s", p, item.ID)
+
+	return nil
+}
+
+// getTrashItems returns the items in the trash of idt, newest first.
+func (s *server) getTrashItems(idt *authlib.Identity) ([]*trashItem, error) {
+
+	dir := s.getTrashDir(idt)
+
+	infos, err := s.storage.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*trashItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*trashItem{}
+	for i := len(infos) - 1; i >= 0; i-- {
+		item, err := s.getTrashItem(path.Join(dir, infos[i].Name()))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (s *server) getTrashItem(itemDir string) (*trashItem, error) {
+
+	fd, err := s.storage.Open(path.Join(itemDir, trashInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	item := &trashItem{}
+	if err := json.NewDecoder(fd).Decode(item); err != nil {
+		return nil, fmt.Errorf("corrupted trash item %s: %s", itemDir, err)
+	}
+
+	return item, nil
+}
+
+// getTrashDir returns the directory that holds the trash of idt.
+func (s *server) getTrashDir(idt *authlib.Identity) string {
+	pid := path.Clean(idt.Pid)
+	return path.Join(trashRoot, string(pid[0]), pid)
+}
+
+// expireTrash purges forever the items older than the retention period.
+func (s *server) expireTrash() {
+
+	ticker := time.NewTicker(trashExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.expireTrashItems()
+		<-ticker.C
+	}
+}
+
+func (s *server) expireTrashItems() {
+
+	// /trash/<letter>/<pid>/<item id>
+	letters, err := s.storage.ReadDir(trashRoot)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, letter := range letters {
+		pids, err := s.storage.ReadDir(path.Join(trashRoot, letter.Name()))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, pid := range pids {
+			dir := path.Join(trashRoot, letter.Name(), pid.Name())
+
+			items, err := s.storage.ReadDir(dir)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			for _, item := range items {
+				deleted := getTimeFromID(item.Name())
+				if time.Since(deleted) <= s.p.trashAge {
+					// items are sorted by deletion time.
+					break
+				}
+
+				p := path.Join(dir, item.Name())
+				if err := s.storage.RemoveAll(p); err != nil {
+					log.Error(err)
+					continue
+				}
+
+				log.Infof("expired trash item %s", p)
+			}
+		}
+	}
+}
+
+// propagateTree saves the entries below the directory p into the propagator.
+func (s *server) propagateTree(ctx context.Context, p string) error {
+
+	infos, err := s.storage.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+
+		child := path.Join(p, info.Name())
+
+		e := &journalEntry{}
+		e.Op = journalOpPut
+		e.Path = child
+
+		err := s.journaled(ctx, e, func() error { return nil })
+		if err != nil && err != errPropagationPending {
+			return err
+		}
+
+		if info.IsDir() {
+			if err := s.propagateTree(ctx, child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func newTrashTestEnv(t *testing.T) *testEnv {
+	return newTestEnv(t, func(p *newServerParams) {
+		p.trash = true
+		p.checksums = []string{"md5"}
+		p.quota = 10
+	})
+}
+
+// listTrash returns the items in the trash of the user of token.
+func (te *testEnv) listTrash(token string) []*trashItem {
+
+	w := te.expect(http.StatusOK, "GET", trashEndPoint, token, "", nil)
+
+	items := []*trashItem{}
+	if err := json.NewDecoder(w.Body).Decode(&items); err != nil {
+		te.t.Fatal(err)
+	}
+	return items
+}
+
+func TestTrash(t *testing.T) {
+
+	te := newTrashTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+	te.expect(http.StatusNoContent, "DELETE", p, tk, "", nil)
+	te.expect(http.StatusNotFound, "GET", p, tk, "", nil)
+
+	items := te.listTrash(tk)
+	if len(items) != 1 || items[0].Path != p || items[0].Size != 5 {
+		t.Fatalf("got trash items %v", items)
+	}
+	id := items[0].ID
+
+	// Items in the trash do not count towards the quota.
+	te.expect(http.StatusCreated, "PUT", p, tk, "0123456789", nil)
+
+	// Nothing is replaced by restoring.
+	te.expect(http.StatusConflict, "POST", trashEndPoint+"/"+id, tk, "", nil)
+	te.expect(http.StatusNoContent, "DELETE", p, tk, "", nil)
+
+	te.expect(http.StatusNoContent, "POST", trashEndPoint+"/"+id, tk, "", nil)
+	w := te.expect(http.StatusOK, "GET", p, tk, "", nil)
+	if w.Body.String() != "hello" {
+		t.Errorf("got %q, want %q", w.Body.String(), "hello")
+	}
+
+	// The checksum is restored into the propagator.
+	if chk := te.prop.getChecksum(p); chk != "md5:5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("restored with checksum %q", chk)
+	}
+
+	if n := len(te.listTrash(tk)); n != 1 {
+		t.Errorf("got %d trash items, want 1", n)
+	}
+
+	// Items of other users cannot be restored.
+	te.expect(http.StatusNotFound, "POST", trashEndPoint+"/"+id, newTestToken("bob", nil), "", nil)
+}
+
+func TestTrashRestoreQuota(t *testing.T) {
+
+	te := newTrashTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	p := testHome + "/a.txt"
+
+	te.expect(http.StatusCreated, "PUT", p, tk, "hello", nil)
+	te.expect(http.StatusNoContent, "DELETE", p, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", testHome+"/b.txt", tk, "0123456789", nil)
+
+	id := te.listTrash(tk)[0].ID
+	te.expect(http.StatusInsufficientStorage, "POST", trashEndPoint+"/"+id, tk, "", nil)
+
+	te.expect(http.StatusNoContent, "DELETE", testHome+"/b.txt", tk, "", nil)
+	te.expect(http.StatusNoContent, "POST", trashEndPoint+"/"+id, tk, "", nil)
+}
+
+func TestTrashRestoreParent(t *testing.T) {
+
+	te := newTrashTestEnv(t)
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	dir := testHome + "/d"
+
+	te.expect(http.StatusCreated, "MKCOL", dir, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", dir+"/a.txt", tk, "hello", nil)
+	te.expect(http.StatusNoContent, "DELETE", dir+"/a.txt", tk, "", nil)
+	te.expect(http.StatusNoContent, "DELETE", dir, tk, "", nil)
+
+	var file, folder string
+	for _, item := range te.listTrash(tk) {
+		if item.IsDir {
+			folder = item.ID
+		} else {
+			file = item.ID
+		}
+	}
+
+	// Files are restored once their parent exists.
+	te.expect(http.StatusConflict, "POST", trashEndPoint+"/"+file, tk, "", nil)
+	te.expect(http.StatusNoContent, "POST", trashEndPoint+"/"+folder, tk, "", nil)
+	te.expect(http.StatusNoContent, "POST", trashEndPoint+"/"+file, tk, "", nil)
+	te.expect(http.StatusOK, "GET", dir+"/a.txt", tk, "", nil)
+
+	// Purged items are gone.
+	te.expect(http.StatusNoContent, "DELETE", dir+"/a.txt", tk, "", nil)
+	te.expect(http.StatusNoContent, "DELETE", trashEndPoint, tk, "", nil)
+	if n := len(te.listTrash(tk)); n != 0 {
+		t.Errorf("got %d trash items after purging, want 0", n)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/clawio/service-auth/lib"
 	"github.com/nu7hatch/gouuid"
 	log "github.com/sirupsen/logrus"
@@ -8,9 +9,12 @@ import (
 	"google.golang.org/grpc/metadata"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func getPathFromReq(r *http.Request) string {
@@ -36,47 +40,104 @@ func getHome(idt *lib.Identity) string {
 func isUnderHome(p string, idt *lib.Identity) bool {
 
 	p = path.Clean(p)
+	home := getHome(idt)
 
-	if strings.HasPrefix(p, getHome(idt)) {
+	if p == home || strings.HasPrefix(p, home+"/") {
 		return true
 	}
 
 	return false
 }
 
-func copyFile(src, dst string, size int64) (err error) {
-	reader, err := os.Open(src)
+// getDestinationFromReq returns the sanitized path of the
+// Destination header. The header can be an absolute URL or a path.
+func getDestinationFromReq(r *http.Request) (string, error) {
+
+	dst := r.Header.Get("Destination")
+	if dst == "" {
+		return "", fmt.Errorf("missing Destination header")
+	}
+
+	u, err := url.Parse(dst)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Clean("/" + u.Path), nil
+}
+
+// getOverwriteFromReq returns the value of the Overwrite header.
+// It defaults to true.
+func getOverwriteFromReq(r *http.Request) bool {
+	return strings.ToUpper(r.Header.Get("Overwrite")) != "F"
+}
+
+// getCreateParentsFromReq reports if the client asked to create the
+// missing parent directories of the path, either with the create_parents
+// query param or with the CIO-Create-Parents header.
+func getCreateParentsFromReq(r *http.Request) bool {
+	v := r.URL.Query().Get("create_parents")
+	if v == "" {
+		v = r.Header.Get("CIO-Create-Parents")
+	}
+	return strings.ToLower(v) == "true" || v == "1"
+}
+
+// copyFile copies the file src to dst through a tmp file.
+// The checksum is computed again while copying and saved with dst
+// into the propagator. precond is passed to commit.
+func (s *server) copyFile(ctx context.Context, src, dst string, precond func(info os.FileInfo) bool) error {
+
+	reader, err := s.storage.Open(src)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
-	writer, err := os.Create(dst)
+	tmpFn, writer, err := s.tmpFile()
 	if err != nil {
 		return err
 	}
-	defer writer.Close()
 
-	_, err = io.CopyN(writer, reader, size)
+	hashers, err := newHashers(s.p.checksums...)
 	if err != nil {
+		writer.Close()
+		os.Remove(tmpFn)
 		return err
 	}
-	return nil
-}
 
-func copyDir(src, dst string) (err error) {
-	err = os.Mkdir(dst, dirPerm)
+	_, err = io.Copy(io.MultiWriter(writer, hashers), reader)
+	writer.Close()
 	if err != nil {
+		os.Remove(tmpFn)
 		return err
 	}
 
-	directory, err := os.Open(src)
-	if err != nil {
+	computed := hashers.getAll()
+	err = s.commit(ctx, tmpFn, dst, findChecksum(computed, s.p.checksums...), computed, precond)
+	if err != nil && err != errPropagationPending {
+		os.Remove(tmpFn)
+	}
+	return err
+}
+
+// copyDir creates the directory dst and, if recursive is true,
+// copies the contents of src into it.
+func (s *server) copyDir(ctx context.Context, src, dst string, recursive bool) error {
+
+	err := s.mkdir(ctx, dst)
+	if err != nil && err != errPropagationPending {
 		return err
 	}
-	defer directory.Close()
 
-	objects, err := directory.Readdir(-1)
+	if !recursive {
+		return nil
+	}
+
+	objects, err := s.storage.ReadDir(src)
+	if err != nil {
+		return err
+	}
 
 	for _, obj := range objects {
 
@@ -85,19 +146,25 @@ func copyDir(src, dst string) (err error) {
 
 		if obj.IsDir() {
 			// create sub-directories - recursively
-			err = copyDir(_src, _dst)
-			if err != nil {
-				return err
-			}
+			err = s.copyDir(ctx, _src, _dst, true)
 		} else {
 			// perform copy
-			err = copyFile(_src, _dst, obj.Size())
-			if err != nil {
-				return err
-			}
+			err = s.copyFile(ctx, _src, _dst, nil)
+		}
+
+		if err != nil && err != errPropagationPending {
+			return err
 		}
 	}
-	return
+
+	return nil
+}
+
+// getTimeFromID returns the time encoded in the ids of versions and
+// trash items, which are unix times in nanoseconds.
+func getTimeFromID(id string) time.Time {
+	nsec, _ := strconv.ParseInt(id, 10, 64)
+	return time.Unix(0, nsec)
 }
 
 // getTraceID returns the traceID that comes in the request
@@ -120,13 +187,23 @@ func newGRPCTraceContext(ctx context.Context, trace string) context.Context {
 	return ctx
 }
 
+// getTraceIDFromContext returns the trace ID stored in ctx
+// by newGRPCTraceContext.
+func getTraceIDFromContext(ctx context.Context) string {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md["trace"]) == 0 {
+		return ""
+	}
+	return md["trace"][0]
+}
+
 type checksum struct {
-	Type string
-	Sum  string
+	Type string `json:"type"`
+	Sum  string `json:"sum"`
 }
 
 func (c *checksum) String() string {
-	if c.Type == "" {
+	if c == nil || c.Type == "" {
 		return ""
 	}
 	return c.Type + ":" + c.Sum
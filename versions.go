@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	authlib "github.com/clawio/service-auth/lib"
+	"github.com/clawio/service-localfs-data/lib"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When versioning is enabled the previous content of a file is kept every
+// time the file is overwritten.
+//
+// Versions live in a per-home area outside the visible home layout:
+// /versions/<letter>/<pid>/<sha1 of the file path>/<version id>
+// where the version id is the time the version was created in nanoseconds.
+// Versions do not count towards the quota of the user.
+//
+// GET <path>?versions lists the versions of a file.
+// GET <path>?version=<id> downloads a version.
+// POST <path>?restore_version=<id> restores a version.
+//
+// The versions follow the file when it is moved and are removed along
+// with it. Versions older than the retention period are removed in the
+// background.
+
+const (
+	versionsRoot = "/versions"
+
+	versionsExpiryInterval = time.Hour
+)
+
+type version struct {
+	ID       string `json:"id"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+func (s *server) listVersions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	p := lib.MustFromContext(ctx)
+
+	dir := s.getVersionsDir(authlib.MustFromContext(ctx), p)
+
+	infos, err := s.storage.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	versions := []*version{}
+	for i := len(infos) - 1; i >= 0; i-- {
+		versions = append(versions, &version{
+			ID:       infos[i].Name(),
+			Size:     infos[i].Size(),
+			Modified: getTimeFromID(infos[i].Name()).Unix(),
+		})
+	}
+
+	log.Infof("%s has %d versions", p, len(versions))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *server) downloadVersion(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	p := lib.MustFromContext(ctx)
+
+	vp, err := s.getVersionPath(authlib.MustFromContext(ctx), p, r.URL.Query().Get("version"))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	s.serveFile(ctx, w, r, vp)
+}
+
+// restoreVersion replaces the file with the content of a version.
+// The current content is saved as a new version, so the restore
+// can be undone.
+func (s *server) restoreVersion(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	log := MustFromLogContext(ctx)
+	p := lib.MustFromContext(ctx)
+
+	vp, err := s.getVersionPath(authlib.MustFromContext(ctx), p, r.URL.Query().Get("restore_version"))
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.storage.Stat(vp); err != nil {
+		log.Error(err)
+		if os.IsNotExist(err) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !s.isParentDir(ctx, p) {
+		log.Errorf("parent of %s does not exist", p)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+
+	err = s.copyFile(ctx, vp, p, nil)
+	if err == errQuotaExceeded {
+		log.Error(err)
+		http.Error(w, "", http.StatusInsufficientStorage)
+		return
+	}
+
+	if err != nil && err != errPropagationPending {
+		log.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("restored %s to version %s", p, path.Base(vp))
+
+	if info, err := s.storage.Stat(p); err == nil {
+		w.Header().Set("ETag", getETag(info))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveVersion moves the current content of p into the versions area.
+// It returns the path of the new version or an empty string if no
+// version was saved because versioning is disabled or p is not a file.
+func (s *server) saveVersion(ctx context.Context, p string) (string, error) {
+
+	if s.p.versions <= 0 {
+		return "", nil
+	}
+
+	info, err := s.storage.Stat(p)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil
+	}
+
+	dir := s.getVersionsDir(authlib.MustFromContext(ctx), p)
+	if err := storageMkdirAll(s.storage, dir); err != nil {
+		return "", err
+	}
+
+	vp := path.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := s.storage.Rename(p, vp); err != nil {
+		return "", err
+	}
+
+	MustFromLogContext(ctx).Infof("saved version %s of %s", path.Base(vp), p)
+
+	s.pruneVersions(ctx, dir)
+
+	return vp, nil
+}
+
+// pruneVersions removes the versions in dir that exceed the maximum
+// number of versions or the maximum age.
+func (s *server) pruneVersions(ctx context.Context, dir string) {
+
+	log := MustFromLogContext(ctx)
+
+	infos, err := s.storage.ReadDir(dir)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// infos are sorted by name, so the oldest versions come first.
+	for i, info := range infos {
+		expired := s.p.versionsAge > 0 &&
+			time.Since(getTimeFromID(info.Name())) > s.p.versionsAge
+
+		if len(infos)-i <= s.p.versions && !expired {
+			continue
+		}
+
+		vp := path.Join(dir, info.Name())
+		if err := s.storage.Remove(vp); err != nil {
+			log.Error(err)
+			continue
+		}
+
+		log.Infof("removed version %s", vp)
+	}
+}
+
+// moveVersions moves the versions of the files below dst, which has just
+// been moved from src, to their new paths. The versions that were kept
+// for the new paths are removed. Files moved to the home of another user
+// lose their versions.
+func (s *server) moveVersions(ctx context.Context, src, dst string) {
+
+	log := MustFromLogContext(ctx)
+
+	srcIdt := getVersionsOwner(ctx, src)
+	dstIdt := getVersionsOwner(ctx, dst)
+
+	if !s.hasVersions(srcIdt) && !s.hasVersions(dstIdt) {
+		return
+	}
+
+	err := walkFiles(s.storage, dst, func(p string) error {
+
+		from := s.getVersionsDir(srcIdt, src+strings.TrimPrefix(p, dst))
+		to := s.getVersionsDir(dstIdt, p)
+
+		if err := s.storage.RemoveAll(to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if _, err := s.storage.Stat(from); os.IsNotExist(err) {
+			return nil
+		}
+
+		// The versions are kept by the owner of the file, so they
+		// are not given to another user.
+		if srcIdt.Pid != dstIdt.Pid {
+			return s.storage.RemoveAll(from)
+		}
+
+		if err := storageMkdirAll(s.storage, path.Dir(to)); err != nil {
+			return err
+		}
+
+		if err := s.storage.Rename(from, to); err != nil {
+			return err
+		}
+
+		log.Infof("moved versions of %s to %s", src+strings.TrimPrefix(p, dst), p)
+		return nil
+	})
+
+	if err != nil {
+		log.Errorf("cannot move versions of %s to %s: %s", src, dst, err)
+	}
+}
+
+// getTreeVersionsDirs returns the directories with the versions of p and
+// of the files below it. They must be got before p is removed and passed
+// to removeVersionsDirs afterwards.
+func (s *server) getTreeVersionsDirs(ctx context.Context, p string) []string {
+
+	idt := getVersionsOwner(ctx, p)
+	if !s.hasVersions(idt) {
+		return nil
+	}
+
+	dirs := []string{}
+	err := walkFiles(s.storage, p, func(p string) error {
+		dirs = append(dirs, s.getVersionsDir(idt, p))
+		return nil
+	})
+
+	if err != nil {
+		MustFromLogContext(ctx).Errorf("cannot find versions of %s: %s", p, err)
+	}
+
+	return dirs
+}
+
+// removeVersionsDirs removes the versions directories dirs.
+func (s *server) removeVersionsDirs(ctx context.Context, dirs []string) {
+
+	log := MustFromLogContext(ctx)
+
+	for _, dir := range dirs {
+		if err := s.storage.RemoveAll(dir); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot remove versions %s: %s", dir, err)
+		}
+	}
+}
+
+// hasVersions reports if idt may have versions of any file.
+func (s *server) hasVersions(idt *authlib.Identity) bool {
+	_, err := s.storage.Stat(getUserVersionsDir(idt))
+	return err == nil
+}
+
+// expireVersions removes forever the versions older than the retention
+// period, also for files that are not overwritten anymore.
+func (s *server) expireVersions() {
+
+	ticker := time.NewTicker(versionsExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.expireOldVersions()
+		<-ticker.C
+	}
+}
+
+func (s *server) expireOldVersions() {
+
+	// /versions/<letter>/<pid>/<sha1 of the file path>/<version id>
+	letters, err := s.storage.ReadDir(versionsRoot)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, letter := range letters {
+		pids, err := s.storage.ReadDir(path.Join(versionsRoot, letter.Name()))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, pid := range pids {
+			pidDir := path.Join(versionsRoot, letter.Name(), pid.Name())
+
+			files, err := s.storage.ReadDir(pidDir)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+
+			for _, file := range files {
+				dir := path.Join(pidDir, file.Name())
+
+				versions, err := s.storage.ReadDir(dir)
+				if err != nil {
+					log.Error(err)
+					continue
+				}
+
+				kept := len(versions)
+				for _, v := range versions {
+					if time.Since(getTimeFromID(v.Name())) <= s.p.versionsAge {
+						// versions are sorted by creation time.
+						break
+					}
+
+					vp := path.Join(dir, v.Name())
+					if err := s.storage.Remove(vp); err != nil {
+						log.Error(err)
+						continue
+					}
+					kept--
+
+					log.Infof("expired version %s", vp)
+				}
+
+				if kept == 0 {
+					if err := s.storage.Remove(dir); err != nil && !os.IsNotExist(err) {
+						log.Error(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// getVersionsOwner returns the identity that keeps the versions of p:
+// the owner of the home p is in or, if p is not in a home, the
+// identity found in ctx. The versions are kept by pid, so the idp of
+// the identity found in ctx is used for the owner.
+func getVersionsOwner(ctx context.Context, p string) *authlib.Identity {
+	idt := authlib.MustFromContext(ctx)
+	if owner := getOwnerIdentity(p, idt.Idp); owner != nil {
+		return owner
+	}
+	return idt
+}
+
+// walkFiles calls fn with p, if it is a file, or with every file below p.
+func walkFiles(st storage, p string, fn func(p string) error) error {
+
+	info, err := st.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fn(p)
+	}
+
+	infos, err := st.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := walkFiles(st, path.Join(p, info.Name()), fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getVersionsDir returns the directory where the versions of p are kept.
+func (s *server) getVersionsDir(idt *authlib.Identity, p string) string {
+	return path.Join(getUserVersionsDir(idt), fmt.Sprintf("%x", sha1.Sum([]byte(p))))
+}
+
+// getUserVersionsDir returns the directory that holds the versions of idt.
+func getUserVersionsDir(idt *authlib.Identity) string {
+	pid := path.Clean(idt.Pid)
+	return path.Join(versionsRoot, string(pid[0]), pid)
+}
+
+// getVersionPath returns the path of the version id of p.
+func (s *server) getVersionPath(idt *authlib.Identity, p, id string) (string, error) {
+
+	// The id is used to build paths, so it must be a number.
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid version id %q", id)
+	}
+
+	return path.Join(s.getVersionsDir(idt, p), id), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// listVersions returns the versions of p.
+func (te *testEnv) listVersions(token, p string) []*version {
+
+	w := te.expect(http.StatusOK, "GET", p+"?versions", token, "", nil)
+
+	versions := []*version{}
+	if err := json.NewDecoder(w.Body).Decode(&versions); err != nil {
+		te.t.Fatal(err)
+	}
+	return versions
+}
+
+func TestVersions(t *testing.T) {
+
+	te := newTestEnv(t, func(p *newServerParams) {
+		p.versions = 5
+	})
+	defer te.close()
+
+	tk := newTestToken("ourense", nil)
+	a, b := testHome+"/a", testHome+"/b"
+
+	for _, data := range []string{"v1", "v2", "v3"} {
+		te.expect(http.StatusCreated, "PUT", a, tk, data, nil)
+	}
+
+	versions := te.listVersions(tk, a)
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want 2", len(versions))
+	}
+
+	contents := map[string]bool{}
+	for _, v := range versions {
+		w := te.expect(http.StatusOK, "GET", a+"?version="+v.ID, tk, "", nil)
+		contents[w.Body.String()] = true
+	}
+	if !contents["v1"] || !contents["v2"] {
+		t.Errorf("got versions %v, want v1 and v2", contents)
+	}
+
+	// The versions follow the file when it is moved.
+	te.expect(http.StatusCreated, "MOVE", a, tk, "", map[string]string{"Destination": b})
+	if n := len(te.listVersions(tk, b)); n != 2 {
+		t.Errorf("got %d versions after moving, want 2", n)
+	}
+
+	// and are removed with it.
+	te.expect(http.StatusNoContent, "DELETE", b, tk, "", nil)
+	te.expect(http.StatusCreated, "PUT", b, tk, "new", nil)
+	if n := len(te.listVersions(tk, b)); n != 0 {
+		t.Errorf("got %d versions of a new file, want 0", n)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// getXattrs returns all the extended attributes of the file fn.
+func getXattrs(fn string) (map[string]string, error) {
+
+	size, err := syscall.Listxattr(fn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	if size == 0 {
+		return attrs, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(fn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The names are separated by null bytes.
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := getXattr(fn, string(name))
+		if err == syscall.ENODATA {
+			// Removed after being listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[string(name)] = value
+	}
+
+	return attrs, nil
+}
+
+func getXattr(fn, name string) (string, error) {
+
+	size, err := syscall.Getxattr(fn, name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if size == 0 {
+		return "", nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(fn, name, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf[:size]), nil
+}
+
+func setXattr(fn, name, value string) error {
+	return syscall.Setxattr(fn, name, []byte(value), 0)
+}
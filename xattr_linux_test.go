@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestLocalStorageAttrs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "localfs-data-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := newLocalStorage(dir)
+	commitTestFile(t, l, "/a", []byte("data"))
+
+	err = l.SetAttrs("/a", map[string]string{attrUploaded: "now", attrChecksumPrefix + "md5": ""})
+	if err == syscall.ENOTSUP {
+		t.Skip("extended attributes are not supported in ", dir)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attributes outside of the user namespace are not returned.
+	if err := setXattr(dir+"/a", "trusted.other", "x"); err != nil && err != syscall.EPERM {
+		t.Fatal(err)
+	}
+
+	attrs, err := l.GetAttrs("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) != 2 || attrs[attrUploaded] != "now" || attrs[attrChecksumPrefix+"md5"] != "" {
+		t.Errorf("got attributes %v", attrs)
+	}
+
+	// Attributes move with the file.
+	if err := l.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err = l.GetAttrs("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs[attrUploaded] != "now" {
+		t.Errorf("got attributes %v after renaming", attrs)
+	}
+}
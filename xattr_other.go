@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+var errXattrsNotSupported = errors.New("extended attributes are not supported on this platform")
+
+func getXattrs(fn string) (map[string]string, error) {
+	return nil, errXattrsNotSupported
+}
+
+func setXattr(fn, name, value string) error {
+	return errXattrsNotSupported
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+// xxhash64 computes the 64 bit xxHash (XXH64) with seed 0.
+// The sum is given in big endian, like the canonical representation.
+type xxhash64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int
+}
+
+// The primes are variables so the arithmetic with them wraps around.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXHash64() hash.Hash64 {
+	x := &xxhash64{}
+	x.Reset()
+	return x
+}
+
+func (x *xxhash64) Reset() {
+	x.v1 = xxPrime1 + xxPrime2
+	x.v2 = xxPrime2
+	x.v3 = 0
+	x.v4 = -xxPrime1
+	x.total = 0
+	x.n = 0
+}
+
+func (x *xxhash64) Size() int      { return 8 }
+func (x *xxhash64) BlockSize() int { return 32 }
+
+func (x *xxhash64) Write(b []byte) (int, error) {
+
+	n := len(b)
+	x.total += uint64(n)
+
+	if x.n+len(b) < 32 {
+		x.n += copy(x.mem[x.n:], b)
+		return n, nil
+	}
+
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], b)
+		x.stripe(x.mem[:])
+		b = b[c:]
+		x.n = 0
+	}
+
+	for ; len(b) >= 32; b = b[32:] {
+		x.stripe(b)
+	}
+
+	x.n = copy(x.mem[:], b)
+	return n, nil
+}
+
+func (x *xxhash64) stripe(b []byte) {
+	x.v1 = xxRound(x.v1, binary.LittleEndian.Uint64(b[0:8]))
+	x.v2 = xxRound(x.v2, binary.LittleEndian.Uint64(b[8:16]))
+	x.v3 = xxRound(x.v3, binary.LittleEndian.Uint64(b[16:24]))
+	x.v4 = xxRound(x.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (x *xxhash64) Sum64() uint64 {
+
+	var h uint64
+	if x.total >= 32 {
+		h = rotl64(x.v1, 1) + rotl64(x.v2, 7) + rotl64(x.v3, 12) + rotl64(x.v4, 18)
+		h = xxMergeRound(h, x.v1)
+		h = xxMergeRound(h, x.v2)
+		h = xxMergeRound(h, x.v3)
+		h = xxMergeRound(h, x.v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += x.total
+
+	b := x.mem[:x.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func (x *xxhash64) Sum(b []byte) []byte {
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], x.Sum64())
+	return append(b, s[:]...)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}